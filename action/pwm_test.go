@@ -0,0 +1,104 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package action_test
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aamcrae/gpio/action"
+	"github.com/aamcrae/gpio/sim"
+)
+
+// levelTimer accumulates the time a pin spends at each level.
+type levelTimer struct {
+	mu    sync.Mutex
+	level int
+	last  time.Time
+	time  [2]time.Duration
+	edges int
+}
+
+func (lt *levelTimer) change(ch sim.Change) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	lt.time[lt.level] += ch.Time.Sub(lt.last)
+	if ch.Level != lt.level {
+		lt.edges++
+	}
+	lt.level, lt.last = ch.Level, ch.Time
+}
+
+// reset starts a new measurement, and returns the previous one.
+func (lt *levelTimer) reset() (high, low time.Duration, edges int) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	now := time.Now()
+	lt.time[lt.level] += now.Sub(lt.last)
+	high, low, edges = lt.time[1], lt.time[0], lt.edges
+	lt.time = [2]time.Duration{}
+	lt.edges = 0
+	lt.last = now
+	return
+}
+
+func TestSwPWM(t *testing.T) {
+	c := sim.NewChip(1)
+	pin, err := c.OutputPin(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pin.Close()
+	lt := &levelTimer{last: time.Now()}
+	c.Observe(0, lt.change)
+	p := action.NewSwPWM(pin)
+	if err := p.Set(10*time.Millisecond, 101); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("Set(101%%): got %v, want ErrInvalid", err)
+	}
+	for _, duty := range []int{25, 75} {
+		p.Set(10*time.Millisecond, duty)
+		// Allow the current period to complete.
+		time.Sleep(20 * time.Millisecond)
+		lt.reset()
+		time.Sleep(200 * time.Millisecond)
+		high, low, edges := lt.reset()
+		got := int(100 * high / (high + low))
+		if got < duty-15 || got > duty+15 {
+			t.Errorf("duty %d%%: measured %d%% (high %v, low %v)", duty, got, high, low)
+		}
+		if edges < 20 {
+			t.Errorf("duty %d%%: %d edges in 200ms", duty, edges)
+		}
+	}
+	for _, duty := range []int{100, 0} {
+		p.Set(10*time.Millisecond, duty)
+		time.Sleep(30 * time.Millisecond)
+		lt.reset()
+		time.Sleep(50 * time.Millisecond)
+		if _, _, edges := lt.reset(); edges != 0 || c.Level(0) != duty/100 {
+			t.Errorf("duty %d%%: %d edges, level %d", duty, edges, c.Level(0))
+		}
+	}
+	p.Set(10*time.Millisecond, 50)
+	p.Close()
+	lt.reset()
+	time.Sleep(30 * time.Millisecond)
+	if _, _, edges := lt.reset(); edges != 0 {
+		t.Errorf("%d edges after Close", edges)
+	}
+}
@@ -15,6 +15,7 @@
 package action
 
 import (
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -26,6 +27,7 @@ const stepperQueueSize = 20 // Size of queue for requests
 type msg struct {
 	speed float64 // RPM
 	steps int
+	off   bool // Remove the power from the motor
 	sync  chan bool
 }
 
@@ -36,13 +38,16 @@ type msg struct {
 // 0 when the stepper is first initialised. This can be a negative or positive number,
 // depending on the movement.
 type Stepper struct {
-	pin1, pin2, pin3, pin4 io.Setter // Pins for controlling outputs
-	factor                 float64   // Number of steps per revolution.
-	mChan                  chan msg  // channel for message requests
-	stopChan               chan bool // channel for signalling resets.
-	index                  int       // Index to step sequence
-	on                     bool      // true if motor drivers on
-	current                int64     // Current step number as an absolute number
+	pin1, pin2, pin3, pin4 io.Setter       // Pins for controlling outputs
+	lines                  io.ValuesSetter // Group of pins for controlling outputs
+	factor                 float64         // Number of steps per revolution.
+	mChan                  chan msg        // channel for message requests
+	stopChan               chan bool       // channel for signalling resets.
+	index                  int             // Index to step sequence
+	on                     bool            // true if motor drivers on, owned by the handler
+	current                int64           // Current step number as an absolute number
+	mu                     sync.RWMutex    // Held for writing when closing
+	closed                 bool
 }
 
 // Half step sequence of outputs.
@@ -62,24 +67,49 @@ var sequence = [][]int{
 // rev is the number of steps per revolution as a reference value for
 // determining the delays between steps.
 func NewStepper(rev int, pin1, pin2, pin3, pin4 io.Setter) *Stepper {
-	s := new(Stepper)
-	// Precalculate a timing factor so that a RPM value can be used
-	// to calculate the per-sequence step delay.
-	s.factor = float64(time.Second.Nanoseconds()*60) / float64(rev)
+	s := newStepper(rev)
 	s.pin1 = pin1
 	s.pin2 = pin2
 	s.pin3 = pin3
 	s.pin4 = pin4
+	go s.handler()
+	return s
+}
+
+// NewStepperLines creates and initialises a Stepper struct, representing
+// a stepper motor controlled by a group of 4 GPIO pins that are set
+// in a single operation (such as io.Lines), so that the motor coils do
+// not see intermediate states between steps.
+// Bits 0 to 3 of the values correspond to the motor inputs 1 to 4.
+func NewStepperLines(rev int, lines io.ValuesSetter) *Stepper {
+	s := newStepper(rev)
+	s.lines = lines
+	go s.handler()
+	return s
+}
+
+func newStepper(rev int) *Stepper {
+	s := new(Stepper)
+	// Precalculate a timing factor so that a RPM value can be used
+	// to calculate the per-sequence step delay.
+	s.factor = float64(time.Second.Nanoseconds()*60) / float64(rev)
 	s.mChan = make(chan msg, stepperQueueSize)
 	s.stopChan = make(chan bool)
-	go s.handler()
 	return s
 }
 
-// Close stops the motor and frees any resources.
+// Close stops the motor and frees any resources. Once closed,
+// the other methods have no effect.
 func (s *Stepper) Close() {
-	s.Stop()
-	s.Off()
+	io.UnregisterSafe(s)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.stop()
+	s.sync(msg{off: true})
 	close(s.mChan)
 	close(s.stopChan)
 }
@@ -103,22 +133,40 @@ func (s *Stepper) Restore(i int) {
 	s.index = i & 7
 }
 
-// Off turns off the GPIOs to remove the power from the motor.
+// Off turns off the GPIOs to remove the power from the motor,
+// once the queued requests have completed.
 func (s *Stepper) Off() {
-	if s.on {
-		s.Wait()
-		s.pin1.Set(0)
-		s.pin2.Set(0)
-		s.pin3.Set(0)
-		s.pin4.Set(0)
-		s.on = false
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.closed {
+		s.sync(msg{off: true})
 	}
 }
 
+// SafeOff registers the motor so that io.SafeState stops the motor
+// and removes the power from it.
+func (s *Stepper) SafeOff() {
+	io.RegisterSafe(s)
+}
+
+// Safe stops the motor and turns off the GPIOs.
+func (s *Stepper) Safe() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.closed {
+		s.stop()
+		s.sync(msg{off: true})
+	}
+	return nil
+}
+
 // Stop aborts any current stepping, and flushes all queued requests.
 func (s *Stepper) Stop() {
-	s.stopChan <- true
-	s.Wait()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.closed {
+		s.stop()
+	}
 }
 
 // Step queues a request to step the motor at the RPM selected for the
@@ -126,20 +174,35 @@ func (s *Stepper) Stop() {
 // If halfSteps is positive, then the motor is run clockwise, otherwise ccw.
 // A number of requests can be queued.
 func (s *Stepper) Step(rpm float64, halfSteps int) {
-	if halfSteps != 0 && rpm > 0.0 {
-		if !s.on {
-			s.output()
-			s.on = true
-		}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.closed && halfSteps != 0 && rpm > 0.0 {
 		s.mChan <- msg{speed: rpm, steps: halfSteps}
 	}
 }
 
 // Wait waits for all requests to complete
 func (s *Stepper) Wait() {
-	c := make(chan bool)
-	s.mChan <- msg{speed: 0, steps: 0, sync: c}
-	<-c
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.closed {
+		s.sync(msg{})
+	}
+}
+
+// stop aborts the stepping and waits for the queued requests to be flushed.
+// The lock must be held.
+func (s *Stepper) stop() {
+	s.stopChan <- true
+	s.sync(msg{})
+}
+
+// sync queues a message, and waits for the handler to process it.
+// The lock must be held.
+func (s *Stepper) sync(m msg) {
+	m.sync = make(chan bool)
+	s.mChan <- m
+	<-m.sync
 }
 
 // goroutine handler
@@ -148,8 +211,15 @@ func (s *Stepper) handler() {
 	for {
 		select {
 		case m := <-s.mChan:
+			if m.off {
+				s.off()
+			}
 			// Request to step the motor
 			if m.steps != 0 {
+				if !s.on {
+					s.output()
+					s.on = true
+				}
 				if s.step(m.speed, m.steps) {
 					return
 				}
@@ -210,6 +280,9 @@ func (s *Stepper) flush() {
 	for {
 		select {
 		case m := <-s.mChan:
+			if m.off {
+				s.off()
+			}
 			if m.sync != nil {
 				m.sync <- true
 				close(m.sync)
@@ -223,9 +296,25 @@ func (s *Stepper) flush() {
 	}
 }
 
+// Remove the power from the motor.
+func (s *Stepper) off() {
+	if s.on {
+		s.set([]int{0, 0, 0, 0})
+		s.on = false
+	}
+}
+
 // Set the GPIO outputs according to the current sequence index.
 func (s *Stepper) output() {
-	seq := sequence[s.index]
+	s.set(sequence[s.index])
+}
+
+// Set the GPIO outputs to the values.
+func (s *Stepper) set(seq []int) {
+	if s.lines != nil {
+		s.lines.SetValues(uint64(seq[0] | seq[1]<<1 | seq[2]<<2 | seq[3]<<3))
+		return
+	}
 	s.pin1.Set(seq[0])
 	s.pin2.Set(seq[1])
 	s.pin3.Set(seq[2])
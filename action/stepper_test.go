@@ -0,0 +1,213 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package action_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aamcrae/gpio"
+	"github.com/aamcrae/gpio/action"
+	"github.com/aamcrae/gpio/sim"
+)
+
+// Half step sequence of the outputs as pin levels 0 to 3.
+var sequence = [][]int{
+	{1, 0, 0, 0},
+	{1, 1, 0, 0},
+	{0, 1, 0, 0},
+	{0, 1, 1, 0},
+	{0, 0, 1, 0},
+	{0, 0, 1, 1},
+	{0, 0, 0, 1},
+	{1, 0, 0, 1},
+}
+
+// checkLevels checks the levels of the first 4 pins of the chip.
+func checkLevels(t *testing.T, c *sim.Chip, want []int) {
+	t.Helper()
+	for i, w := range want {
+		if v := c.Level(i); v != w {
+			t.Errorf("pin %d: got %d, want %d (levels %v)", i, v, w, want)
+		}
+	}
+}
+
+// newStepper creates a stepper driven by 4 simulated output pins.
+func newStepper(t *testing.T, c *sim.Chip) *action.Stepper {
+	var pins [4]*sim.Pin
+	for i := range pins {
+		p, err := c.OutputPin(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(p.Close)
+		pins[i] = p
+	}
+	return action.NewStepper(4096, pins[0], pins[1], pins[2], pins[3])
+}
+
+func TestStepper(t *testing.T) {
+	c := sim.NewChip(4)
+	s := newStepper(t, c)
+	defer s.Close()
+	s.Step(600, 3)
+	s.Wait()
+	if s.GetStep() != 3 || s.State() != 3 {
+		t.Errorf("after 3 steps: step %d state %d", s.GetStep(), s.State())
+	}
+	checkLevels(t, c, sequence[3])
+	s.Step(600, -5)
+	s.Wait()
+	if s.GetStep() != -2 || s.State() != 6 {
+		t.Errorf("after -5 steps: step %d state %d", s.GetStep(), s.State())
+	}
+	checkLevels(t, c, sequence[6])
+	s.Off()
+	checkLevels(t, c, []int{0, 0, 0, 0})
+	// Stepping again powers the outputs.
+	s.Step(600, 1)
+	s.Wait()
+	checkLevels(t, c, sequence[7])
+}
+
+func TestStepperStop(t *testing.T) {
+	c := sim.NewChip(4)
+	s := newStepper(t, c)
+	defer s.Close()
+	// 1 RPM is a step every 15ms.
+	s.Step(1, 1000)
+	s.Step(1, 1000)
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	s.Stop()
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("Stop took %v", d)
+	}
+	step := s.GetStep()
+	if step <= 0 || step >= 1000 {
+		t.Errorf("stopped at step %d", step)
+	}
+	// The queued request was flushed.
+	time.Sleep(50 * time.Millisecond)
+	if s.GetStep() != step {
+		t.Errorf("stepping continued after Stop: %d to %d", step, s.GetStep())
+	}
+	if err := s.Safe(); err != nil {
+		t.Fatal(err)
+	}
+	checkLevels(t, c, []int{0, 0, 0, 0})
+}
+
+func TestStepperLines(t *testing.T) {
+	c := sim.NewChip(4)
+	l, err := c.Lines(io.OUT, 0, 1, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// Each change of the outputs must be a step of the sequence.
+	var bad []int
+	c.Observe(0, func(sim.Change) {
+		var lv []int
+		for i := 0; i < 4; i++ {
+			lv = append(lv, c.Level(i))
+		}
+		for _, s := range append(sequence, []int{0, 0, 0, 0}) {
+			if s[0] == lv[0] && s[1] == lv[1] && s[2] == lv[2] && s[3] == lv[3] {
+				return
+			}
+		}
+		bad = lv
+	})
+	s := action.NewStepperLines(4096, l)
+	defer s.Close()
+	s.Step(600, 16)
+	s.Wait()
+	if s.GetStep() != 16 {
+		t.Errorf("GetStep: got %d, want 16", s.GetStep())
+	}
+	checkLevels(t, c, sequence[0])
+	if bad != nil {
+		t.Errorf("intermediate state %v", bad)
+	}
+}
+
+func TestStepperSafe(t *testing.T) {
+	c := sim.NewChip(4)
+	s := newStepper(t, c)
+	defer s.Close()
+	s.SafeOff()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			s.Step(600, 2)
+		}
+	}()
+	time.Sleep(5 * time.Millisecond)
+	if err := io.SafeState(); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	s.Safe()
+	checkLevels(t, c, []int{0, 0, 0, 0})
+}
+
+func TestStepperClosed(t *testing.T) {
+	c := sim.NewChip(4)
+	s := newStepper(t, c)
+	s.SafeOff()
+	s.Step(600, 100)
+	s.Close()
+	checkLevels(t, c, []int{0, 0, 0, 0})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Off()
+		s.Safe()
+		s.Stop()
+		s.Step(600, 10)
+		s.Wait()
+		s.Close()
+		// The stepper is no longer registered.
+		if err := io.SafeState(); err != nil {
+			t.Error(err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("calls after Close did not return")
+	}
+	checkLevels(t, c, []int{0, 0, 0, 0})
+}
+
+func TestStepperSafeClose(t *testing.T) {
+	c := sim.NewChip(4)
+	s := newStepper(t, c)
+	s.SafeOff()
+	s.Step(600, 100)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			io.SafeState()
+		}
+	}()
+	s.Close()
+	<-done
+	checkLevels(t, c, []int{0, 0, 0, 0})
+}
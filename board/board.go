@@ -0,0 +1,142 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package board maps board header positions to GPIO line names, so
+// that pins can be selected independently of the kernel GPIO numbering.
+package board
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aamcrae/gpio"
+)
+
+// Header is a map of physical header pin numbers to the names of the
+// GPIO lines connected to them. Pins that are not GPIOs (power and ground)
+// are not present.
+type Header map[int]string
+
+// RaspberryPi is the 40 pin header of the Raspberry Pi (B+ and later),
+// using the line names provided by the kernel, which are based on the BCM
+// GPIO numbers.
+var RaspberryPi = Header{
+	3:  "GPIO2",
+	5:  "GPIO3",
+	7:  "GPIO4",
+	8:  "GPIO14",
+	10: "GPIO15",
+	11: "GPIO17",
+	12: "GPIO18",
+	13: "GPIO27",
+	15: "GPIO22",
+	16: "GPIO23",
+	18: "GPIO24",
+	19: "GPIO10",
+	21: "GPIO9",
+	22: "GPIO25",
+	23: "GPIO11",
+	24: "GPIO8",
+	26: "GPIO7",
+	27: "GPIO0",
+	28: "GPIO1",
+	29: "GPIO5",
+	31: "GPIO6",
+	32: "GPIO12",
+	33: "GPIO13",
+	35: "GPIO19",
+	36: "GPIO16",
+	37: "GPIO26",
+	38: "GPIO20",
+	40: "GPIO21",
+}
+
+// BCM returns the line name of a Broadcom (BCM) GPIO number.
+func BCM(n int) string {
+	return fmt.Sprintf("GPIO%d", n)
+}
+
+// Name returns the line name of the physical header pin.
+func (h Header) Name(pin int) (string, error) {
+	n, ok := h[pin]
+	if !ok {
+		return "", fmt.Errorf("header pin %d: not a GPIO: %w", pin, os.ErrNotExist)
+	}
+	return n, nil
+}
+
+// Resolve converts a pin description to a line name. The description
+// may be a header pin ("pin 11", "header pin 11"), a BCM number
+// ("BCM17"), or a line name ("GPIO17", "P11"), which is returned unchanged.
+// A header pin requires the "pin" prefix, since names such as "P11" are
+// used as line names on some boards.
+func (h Header) Resolve(s string) (string, error) {
+	f := strings.Fields(strings.ToLower(s))
+	if len(f) > 0 && f[0] == "header" {
+		f = f[1:]
+	}
+	d := strings.Join(f, "")
+	if strings.HasPrefix(d, "pin") {
+		if n, err := strconv.Atoi(d[3:]); err == nil {
+			return h.Name(n)
+		}
+	}
+	if strings.HasPrefix(d, "bcm") {
+		if n, err := strconv.Atoi(d[3:]); err == nil {
+			return BCM(n), nil
+		}
+	}
+	if len(f) != 1 {
+		return "", fmt.Errorf("%q: unknown pin: %w", s, os.ErrInvalid)
+	}
+	return strings.TrimSpace(s), nil
+}
+
+// Pin opens the physical header pin as an input.
+func (h Header) Pin(pin int, opts ...io.Option) (*io.Line, error) {
+	n, err := h.Name(pin)
+	if err != nil {
+		return nil, err
+	}
+	return io.PinByName(n, opts...)
+}
+
+// OutputPin opens the physical header pin as an output.
+func (h Header) OutputPin(pin int, opts ...io.Option) (*io.Line, error) {
+	n, err := h.Name(pin)
+	if err != nil {
+		return nil, err
+	}
+	return io.OutputPinByName(n, opts...)
+}
+
+// Open resolves the pin description and opens the line as an input.
+func (h Header) Open(s string, opts ...io.Option) (*io.Line, error) {
+	n, err := h.Resolve(s)
+	if err != nil {
+		return nil, err
+	}
+	return io.PinByName(n, opts...)
+}
+
+// OpenOutput resolves the pin description and opens the line as an output.
+func (h Header) OpenOutput(s string, opts ...io.Option) (*io.Line, error) {
+	n, err := h.Resolve(s)
+	if err != nil {
+		return nil, err
+	}
+	return io.OutputPinByName(n, opts...)
+}
@@ -0,0 +1,54 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package board
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		desc string
+		want string
+		err  error
+	}{
+		{"pin 11", "GPIO17", nil},
+		{"Header Pin 40", "GPIO21", nil},
+		{"PIN3", "GPIO2", nil},
+		{"BCM17", "GPIO17", nil},
+		{"bcm 4", "GPIO4", nil},
+		{"GPIO17", "GPIO17", nil},
+		// Names without the pin prefix are line names.
+		{"P1", "P1", nil},
+		{"p11", "p11", nil},
+		{"pin 1", "", os.ErrNotExist},
+		{"pin 41", "", os.ErrNotExist},
+		{"some pin", "", os.ErrInvalid},
+	}
+	for _, tc := range tests {
+		got, err := RaspberryPi.Resolve(tc.desc)
+		if tc.err != nil {
+			if !errors.Is(err, tc.err) {
+				t.Errorf("Resolve(%q): got %q, %v, want %v", tc.desc, got, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("Resolve(%q): got %q, %v, want %q", tc.desc, got, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,613 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// GPIO character device (gpio-cdev v2) interface.
+
+package io
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	gpioChipDev      = "/dev/gpiochip%d"
+	gpioConsumer     = "gpio"
+	gpioMaxNameSize  = 32
+	gpioV2LinesMax   = 64
+	gpioV2NumAttrMax = 10
+	gpioEventSize    = 48 // Size of struct gpio_v2_line_event
+)
+
+// Attribute ids
+const (
+	gpioV2AttrFlags        = 1
+	gpioV2AttrOutputValues = 2
+	gpioV2AttrDebounce     = 3
+)
+
+// Event ids
+const (
+	gpioV2EventRising  = 1
+	gpioV2EventFalling = 2
+)
+
+// Line flags
+const (
+	gpioV2FlagUsed        = 1 << 0
+	gpioV2FlagActiveLow   = 1 << 1
+	gpioV2FlagInput       = 1 << 2
+	gpioV2FlagOutput      = 1 << 3
+	gpioV2FlagEdgeRising  = 1 << 4
+	gpioV2FlagEdgeFalling = 1 << 5
+	gpioV2FlagOpenDrain   = 1 << 6
+	gpioV2FlagOpenSource  = 1 << 7
+	gpioV2FlagPullUp      = 1 << 8
+	gpioV2FlagPullDown    = 1 << 9
+	gpioV2FlagBiasDisable = 1 << 10
+
+	gpioV2FlagDrive = gpioV2FlagOpenDrain | gpioV2FlagOpenSource
+)
+
+const gpioCode uintptr = 0xB4
+
+var (
+	gpioGetChipInfo = iocR(gpioCode, 0x01, unsafe.Sizeof(gpiochip_info{}))
+	gpioV2GetLine   = iocRW(gpioCode, 0x07, unsafe.Sizeof(gpio_v2_line_request{}))
+	gpioV2SetConfig = iocRW(gpioCode, 0x0D, unsafe.Sizeof(gpio_v2_line_config{}))
+	gpioV2GetValues = iocRW(gpioCode, 0x0E, unsafe.Sizeof(gpio_v2_line_values{}))
+	gpioV2SetValues = iocRW(gpioCode, 0x0F, unsafe.Sizeof(gpio_v2_line_values{}))
+)
+
+type gpiochip_info struct {
+	name  [gpioMaxNameSize]byte
+	label [gpioMaxNameSize]byte
+	lines uint32
+}
+
+type gpio_v2_line_attribute struct {
+	id    uint32
+	_     uint32
+	value uint64 // Flags, output values or debounce period
+}
+
+type gpio_v2_line_config_attribute struct {
+	attr gpio_v2_line_attribute
+	mask uint64
+}
+
+type gpio_v2_line_config struct {
+	flags     uint64
+	num_attrs uint32
+	_         [5]uint32
+	attrs     [gpioV2NumAttrMax]gpio_v2_line_config_attribute
+}
+
+type gpio_v2_line_request struct {
+	offsets           [gpioV2LinesMax]uint32
+	consumer          [gpioMaxNameSize]byte
+	config            gpio_v2_line_config
+	num_lines         uint32
+	event_buffer_size uint32
+	_                 [5]uint32
+	fd                int32
+}
+
+type gpio_v2_line_values struct {
+	bits uint64
+	mask uint64
+}
+
+type gpio_v2_line_event struct {
+	timestamp_ns uint64
+	id           uint32
+	offset       uint32
+	seqno        uint32
+	line_seqno   uint32
+	_            [6]uint32
+}
+
+// Chip represents a GPIO character device (/dev/gpiochipN).
+type Chip struct {
+	number int
+	file   *os.File
+	name   string
+	label  string
+	lines  int
+}
+
+// Line represents one GPIO line requested from a GPIO character device.
+// It provides the same interface as Gpio.
+type Line struct {
+	chip      int
+	offset    int
+	fd        int
+	direction int
+	edge      int
+	flags     uint64        // Bias, drive and active low flags
+	debounce  time.Duration // Kernel debounce period
+	db        debounce      // Software debounce
+	evbuf     []byte
+	safe      int     // Safe value
+	hasSafe   bool    // Safe value has been registered
+	pollers   pollers // Pollers waiting for edges
+	mu        sync.Mutex
+	closed    bool
+}
+
+// OpenChip opens a GPIO character device.
+func OpenChip(chip int) (*Chip, error) {
+	c := new(Chip)
+	c.number = chip
+	var err error
+	c.file, err = os.OpenFile(rootPath(fmt.Sprintf(gpioChipDev, chip)), os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	var info gpiochip_info
+	err = ioctl(c.file.Fd(), gpioGetChipInfo, uintptr(unsafe.Pointer(&info)))
+	if err != nil {
+		c.file.Close()
+		return nil, pinError(fmt.Sprintf("gpiochip%d", chip), "chip info", err)
+	}
+	c.name = cString(info.name[:])
+	c.label = cString(info.label[:])
+	c.lines = int(info.lines)
+	return c, nil
+}
+
+// ChipPin opens a line on a GPIO character device as an input.
+// The chip is only held open for the duration of the request.
+func ChipPin(chip, offset int, opts ...Option) (*Line, error) {
+	c, err := OpenChip(chip)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return c.Pin(offset, opts...)
+}
+
+// ChipOutputPin opens a line on a GPIO character device as an output.
+func ChipOutputPin(chip, offset int, opts ...Option) (*Line, error) {
+	c, err := OpenChip(chip)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return c.OutputPin(offset, opts...)
+}
+
+// Close closes the chip. Lines requested from the chip remain valid.
+func (c *Chip) Close() {
+	c.file.Close()
+}
+
+// Name returns the kernel name of the chip.
+func (c *Chip) Name() string {
+	return c.name
+}
+
+// Label returns the functional name of the chip.
+func (c *Chip) Label() string {
+	return c.label
+}
+
+// NumLines returns the number of lines on the chip.
+func (c *Chip) NumLines() int {
+	return c.lines
+}
+
+// OutputPin requests a line from the chip and sets the direction as OUTPUT.
+func (c *Chip) OutputPin(offset int, opts ...Option) (*Line, error) {
+	return c.request(offset, OUT, opts)
+}
+
+// Pin requests a line from the chip as an input.
+// All of the bias, drive and active low options are supported, though
+// the drive mode only applies when the line is an output.
+func (c *Chip) Pin(offset int, opts ...Option) (*Line, error) {
+	return c.request(offset, IN, opts)
+}
+
+// request requests one line from the chip with the direction selected.
+func (c *Chip) request(offset, dir int, opts []Option) (*Line, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	flags := cfg.lineFlags()
+	fd, err := c.requestLines(dir, flags, cfg.consumer, []int{offset})
+	if err != nil {
+		return nil, err
+	}
+	l := new(Line)
+	l.chip = c.number
+	l.offset = offset
+	l.fd = fd
+	l.flags = flags
+	l.direction = dir
+	l.edge = NONE
+	l.evbuf = make([]byte, gpioEventSize*16)
+	return l, nil
+}
+
+// requestLines requests a set of lines from the chip with the direction selected,
+// and returns the file descriptor of the line request.
+// The lines are reserved in the registry for the consumer.
+func (c *Chip) requestLines(dir int, flags uint64, consumer string, offsets []int) (int, error) {
+	res := fmt.Sprintf("gpiochip%d/%v", c.number, offsets)
+	if len(offsets) == 1 {
+		res = lineResource(c.number, offsets[0])
+	}
+	if len(offsets) == 0 || len(offsets) > gpioV2LinesMax {
+		return -1, pinError(res, "request", os.ErrInvalid)
+	}
+	var req gpio_v2_line_request
+	for i, offset := range offsets {
+		if offset < 0 || offset >= c.lines {
+			return -1, pinError(res, "request", os.ErrInvalid)
+		}
+		req.offsets[i] = uint32(offset)
+	}
+	for i, offset := range offsets {
+		if err := reserve(lineResource(c.number, offset), consumer, false); err != nil {
+			releaseLines(c.number, offsets[:i])
+			return -1, err
+		}
+	}
+	copy(req.consumer[:gpioMaxNameSize-1], consumer)
+	req.config.flags = lineFlags(dir, NONE, flags)
+	req.num_lines = uint32(len(offsets))
+	err := ioctl(c.file.Fd(), gpioV2GetLine, uintptr(unsafe.Pointer(&req)))
+	if err != nil {
+		releaseLines(c.number, offsets)
+		if errors.Is(err, unix.EBUSY) {
+			// Held by another process, so report the kernel's consumer.
+			for _, offset := range offsets {
+				if info, ierr := c.lineInfo(offset); ierr == nil && info.flags&gpioV2FlagUsed != 0 {
+					return -1, &BusyError{Resource: lineResource(c.number, offset), Consumer: cString(info.consumer[:])}
+				}
+			}
+		}
+		return -1, pinError(res, "request", err)
+	}
+	return int(req.fd), nil
+}
+
+// lineResource returns the name of a line in the registry.
+func lineResource(chip, offset int) string {
+	return fmt.Sprintf("gpiochip%d/%d", chip, offset)
+}
+
+// releaseLines releases a set of lines from the registry.
+func releaseLines(chip int, offsets []int) {
+	for _, offset := range offsets {
+		release(lineResource(chip, offset))
+	}
+}
+
+// Direction sets the mode (direction) of the line.
+// Edge detection is only active on inputs, but the edge setting is
+// retained while the line is an output, so that edge detection resumes
+// when the line is an input again.
+func (l *Line) Direction(d int) error {
+	if d != IN && d != OUT {
+		return pinError(l.resource(), "direction", os.ErrInvalid)
+	}
+	err := l.config(lineFlags(d, l.edge, l.flags))
+	if err == nil {
+		l.direction = d
+	}
+	return pinError(l.resource(), "direction", err)
+}
+
+// GetEdge returns the edge detection setting of the line.
+func (l *Line) GetEdge() int {
+	return l.edge
+}
+
+// Edge sets the edge detection on the line.
+func (l *Line) Edge(e int) error {
+	if l.direction != IN {
+		return pinError(l.resource(), "edge", ErrNotInput)
+	}
+	if e < NONE || e > BOTH {
+		return pinError(l.resource(), "edge", os.ErrInvalid)
+	}
+	err := l.config(lineFlags(IN, e, l.flags))
+	if err == nil {
+		l.edge = e
+		l.db.stable = -1
+	}
+	return pinError(l.resource(), "edge", err)
+}
+
+// Set the output of the line (only valid for OUTPUT lines)
+func (l *Line) Set(v int) error {
+	if l.direction != OUT {
+		return pinError(l.resource(), "set", ErrNotOutput)
+	}
+	if v != 0 && v != 1 {
+		return pinError(l.resource(), "set", os.ErrInvalid)
+	}
+	vals := gpio_v2_line_values{bits: uint64(v), mask: 1}
+	return pinError(l.resource(), "set", ioctl(uintptr(l.fd), gpioV2SetValues, uintptr(unsafe.Pointer(&vals))))
+}
+
+// Get returns the current value of the line.
+func (l *Line) Get() (int, error) {
+	return l.GetTimeout(0)
+}
+
+// GetTimeout is used when detecting edges, and a timeout is required.
+// A timeout of 0 is interpreted as no timeout.
+// As with Gpio, if edge detection is enabled the call waits for an edge
+// event before returning the value. An output line has no edge detection,
+// so the value is returned without waiting.
+func (l *Line) GetTimeout(tout time.Duration) (int, error) {
+	v, err := l.getContext(context.Background(), tout)
+	return v, pinError(l.resource(), "get", err)
+}
+
+// GetContext is used when detecting edges, and waits for an edge
+// until the context is done, in which case the context error is returned.
+func (l *Line) GetContext(ctx context.Context) (int, error) {
+	v, err := l.getContext(ctx, 0)
+	return v, pinError(l.resource(), "get", err)
+}
+
+// Debounce sets the debounce period for edge detection, so that an
+// edge is only reported once the level has been stable for the period.
+// The kernel debounce support is used if available, which also applies to
+// Events, otherwise edges reported by Get and GetTimeout are filtered
+// in software. A period of 0 disables debouncing.
+func (l *Line) Debounce(d time.Duration) error {
+	if d < 0 {
+		return pinError(l.resource(), "debounce", os.ErrInvalid)
+	}
+	l.debounce = d
+	l.db = debounce{stable: -1}
+	err := l.config(lineFlags(l.direction, l.edge, l.flags))
+	if err != nil && d != 0 {
+		// Fall back to software debouncing.
+		l.debounce = 0
+		l.db.period = d
+		err = l.config(lineFlags(l.direction, l.edge, l.flags))
+	}
+	return pinError(l.resource(), "debounce", err)
+}
+
+// getContext waits for an edge event (if edge detection is enabled) and
+// returns the value of the line.
+func (l *Line) getContext(ctx context.Context, tout time.Duration) (int, error) {
+	if l.direction != IN || l.edge == NONE {
+		return l.value()
+	}
+	p, err := newCtxPoller(ctx, &l.pollers, l.fd, unix.POLLIN)
+	if err != nil {
+		return 0, err
+	}
+	defer p.close()
+	return l.db.wait(l.edge, tout, func(tout time.Duration) (int, error) {
+		_, err := p.wait(tout)
+		if err != nil {
+			return 0, err
+		}
+		// Consume the queued edge events.
+		_, err = unix.Read(l.fd, l.evbuf)
+		if err != nil {
+			return 0, err
+		}
+		return l.value()
+	}, l.value)
+}
+
+// value returns the current value of the line.
+func (l *Line) value() (int, error) {
+	var vals gpio_v2_line_values
+	vals.mask = 1
+	err := ioctl(uintptr(l.fd), gpioV2GetValues, uintptr(unsafe.Pointer(&vals)))
+	if err != nil {
+		return 0, err
+	}
+	return int(vals.bits & 1), nil
+}
+
+// Events returns a channel of edge events detected on the line.
+// Edge detection must be enabled via Edge before Events is called.
+// The events carry the kernel timestamp and sequence number, so events
+// discarded by the kernel event buffer show up as gaps in the sequence.
+// The channel is closed when the context is done or the line is closed.
+// GetTimeout should not be called while events are being read.
+func (l *Line) Events(ctx context.Context) (<-chan Event, error) {
+	if l.edge == NONE {
+		return nil, pinError(l.resource(), "events", ErrNoEdge)
+	}
+	buf := make([]byte, len(l.evbuf))
+	c, err := runEvents(ctx, &l.pollers, l.fd, unix.POLLIN, func(p *ctxPoller) ([]Event, error) {
+		_, err := p.wait(0)
+		if err != nil {
+			return nil, err
+		}
+		return l.readEvents(buf)
+	})
+	return c, pinError(l.resource(), "events", err)
+}
+
+// WatchFd returns the file descriptor and epoll events used to watch the line.
+func (l *Line) WatchFd() (int, uint32, error) {
+	if l.edge == NONE {
+		return 0, 0, pinError(l.resource(), "watch", ErrNoEdge)
+	}
+	return l.fd, unix.EPOLLIN, nil
+}
+
+// WatchEvents returns the events for edges detected by a Watcher.
+func (l *Line) WatchEvents() ([]Event, error) {
+	evs, err := l.readEvents(l.evbuf)
+	return evs, pinError(l.resource(), "watch", err)
+}
+
+// readEvents reads the pending edge events from the line.
+func (l *Line) readEvents(buf []byte) ([]Event, error) {
+	n, err := unix.Read(l.fd, buf)
+	if err != nil {
+		return nil, err
+	}
+	var evs []Event
+	for i := 0; i+gpioEventSize <= n; i += gpioEventSize {
+		ke := (*gpio_v2_line_event)(unsafe.Pointer(&buf[i]))
+		e := Event{Time: time.Duration(ke.timestamp_ns), Seq: uint64(ke.line_seqno)}
+		if ke.id == gpioV2EventRising {
+			e.Edge = RISING
+			e.Level = 1
+		} else {
+			e.Edge = FALLING
+		}
+		evs = append(evs, e)
+	}
+	return evs, nil
+}
+
+// Close releases the line. Calls waiting for an edge on the line
+// return os.ErrClosed, and channels returned by Events are closed.
+// Closing a line more than once has no effect.
+func (l *Line) Close() {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return
+	}
+	l.closed = true
+	l.mu.Unlock()
+	if l.hasSafe {
+		UnregisterSafe(l)
+		l.safeValue()
+	}
+	l.pollers.close()
+	unix.Close(l.fd)
+	release(l.resource())
+}
+
+// resource returns the name of the line in the registry.
+func (l *Line) resource() string {
+	return lineResource(l.chip, l.offset)
+}
+
+// SafeValue registers the value that the line is set to when
+// SafeState is called, or the line is closed.
+func (l *Line) SafeValue(v int) error {
+	if v != 0 && v != 1 {
+		return pinError(l.resource(), "safe value", os.ErrInvalid)
+	}
+	l.safe = v
+	l.hasSafe = true
+	RegisterSafe(l)
+	return nil
+}
+
+// Safe sets the line as an output with the safe value.
+// Once the line is closed, Safe has no effect.
+func (l *Line) Safe() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	return l.safeValue()
+}
+
+// safeValue sets the line as an output with the safe value.
+func (l *Line) safeValue() error {
+	if l.direction != OUT {
+		if err := l.Direction(OUT); err != nil {
+			return err
+		}
+	}
+	return l.Set(l.safe)
+}
+
+// config applies a new set of flags to the line, along with the
+// debounce period for inputs.
+func (l *Line) config(flags uint64) error {
+	var cfg gpio_v2_line_config
+	cfg.flags = flags
+	if l.debounce != 0 && flags&gpioV2FlagInput != 0 {
+		// The debounce period is a 32 bit value in the attribute union.
+		cfg.num_attrs = 1
+		cfg.attrs[0].attr.id = gpioV2AttrDebounce
+		*(*uint32)(unsafe.Pointer(&cfg.attrs[0].attr.value)) = uint32(l.debounce.Microseconds())
+		cfg.attrs[0].mask = 1
+	}
+	return ioctl(uintptr(l.fd), gpioV2SetConfig, uintptr(unsafe.Pointer(&cfg)))
+}
+
+// lineFlags returns the line flags for the direction and edge selected,
+// combined with the bias, drive and active low flags.
+func lineFlags(dir, edge int, flags uint64) uint64 {
+	if dir == OUT {
+		return flags | gpioV2FlagOutput
+	}
+	// The drive mode is only valid for outputs.
+	flags = (flags &^ gpioV2FlagDrive) | gpioV2FlagInput
+	switch edge {
+	case RISING:
+		flags |= gpioV2FlagEdgeRising
+	case FALLING:
+		flags |= gpioV2FlagEdgeFalling
+	case BOTH:
+		flags |= gpioV2FlagEdgeRising | gpioV2FlagEdgeFalling
+	}
+	return flags
+}
+
+// lineFlags returns the line flags for the options selected.
+func (c *config) lineFlags() uint64 {
+	var flags uint64
+	switch c.bias {
+	case BiasDisabled:
+		flags |= gpioV2FlagBiasDisable
+	case BiasPullUp:
+		flags |= gpioV2FlagPullUp
+	case BiasPullDown:
+		flags |= gpioV2FlagPullDown
+	}
+	switch c.drive {
+	case DriveOpenDrain:
+		flags |= gpioV2FlagOpenDrain
+	case DriveOpenSource:
+		flags |= gpioV2FlagOpenSource
+	}
+	if c.activeLow {
+		flags |= gpioV2FlagActiveLow
+	}
+	return flags
+}
+
+// cString converts a NUL terminated byte array to a string.
+func cString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
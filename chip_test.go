@@ -0,0 +1,532 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package io
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// fakeLine is a line request on a fakeChip.
+type fakeLine struct {
+	offsets []int
+	flags   uint64
+	attrs   []gpio_v2_line_config_attribute
+	values  uint64
+	wfd     int    // Write end of the pipe used as the request fd
+	ino     uint64 // Inode of the read end, to detect when it is closed
+}
+
+// fakeChip emulates the GPIO character device ioctls.
+type fakeChip struct {
+	t     *testing.T
+	mu    sync.Mutex
+	lines int
+	held  map[int]string    // Consumer of held offsets
+	reqs  map[int]*fakeLine // Requests by fd
+	// noDebounce rejects the debounce attribute, as on kernels without
+	// debounce support.
+	noDebounce bool
+}
+
+// newFakeChip creates /dev/gpiochip0 in a temporary root, and replaces
+// the ioctl function with the fake until the test completes.
+func newFakeChip(t *testing.T, lines int) *fakeChip {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "dev"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "dev", "gpiochip0"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeChip{t: t, lines: lines, held: make(map[int]string), reqs: make(map[int]*fakeLine)}
+	oldRoot, oldIoctl := Root, ioctl
+	Root = root
+	ioctl = f.ioctl
+	t.Cleanup(func() {
+		Root, ioctl = oldRoot, oldIoctl
+		for _, l := range f.reqs {
+			unix.Close(l.wfd)
+		}
+	})
+	return f
+}
+
+// ptr converts an ioctl argument back to a pointer.
+func ptr(arg uintptr) unsafe.Pointer {
+	return *(*unsafe.Pointer)(unsafe.Pointer(&arg))
+}
+
+func (f *fakeChip) ioctl(fd, req, arg uintptr) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch req {
+	case gpioGetChipInfo:
+		info := (*gpiochip_info)(ptr(arg))
+		copy(info.name[:], "gpiochip0")
+		copy(info.label[:], "fake")
+		info.lines = uint32(f.lines)
+	case gpioV2GetLineInfo:
+		info := (*gpio_v2_line_info)(ptr(arg))
+		copy(info.name[:], "L"+string(rune('0'+info.offset)))
+		if c, ok := f.held[int(info.offset)]; ok {
+			info.flags |= gpioV2FlagUsed
+			copy(info.consumer[:], c)
+		}
+	case gpioV2GetLine:
+		r := (*gpio_v2_line_request)(ptr(arg))
+		f.line(0)
+		l := &fakeLine{flags: r.config.flags}
+		for _, o := range r.offsets[:r.num_lines] {
+			if _, ok := f.held[int(o)]; ok {
+				return unix.EBUSY
+			}
+			l.offsets = append(l.offsets, int(o))
+		}
+		var p [2]int
+		if err := unix.Pipe2(p[:], unix.O_CLOEXEC); err != nil {
+			return err
+		}
+		l.wfd = p[1]
+		var st unix.Stat_t
+		unix.Fstat(p[0], &st)
+		l.ino = st.Ino
+		for _, o := range l.offsets {
+			f.held[o] = cString(r.consumer[:])
+		}
+		f.reqs[p[0]] = l
+		r.fd = int32(p[0])
+	case gpioV2SetConfig:
+		l := f.line(fd)
+		if l == nil {
+			return unix.EBADF
+		}
+		c := (*gpio_v2_line_config)(ptr(arg))
+		if f.noDebounce && c.num_attrs != 0 {
+			return unix.EINVAL
+		}
+		l.flags = c.flags
+		l.attrs = append([]gpio_v2_line_config_attribute(nil), c.attrs[:c.num_attrs]...)
+	case gpioV2GetValues:
+		l := f.line(fd)
+		if l == nil {
+			return unix.EBADF
+		}
+		v := (*gpio_v2_line_values)(ptr(arg))
+		v.bits = l.values & v.mask
+	case gpioV2SetValues:
+		l := f.line(fd)
+		if l == nil {
+			return unix.EBADF
+		}
+		if l.flags&gpioV2FlagOutput == 0 {
+			return unix.EPERM
+		}
+		v := (*gpio_v2_line_values)(ptr(arg))
+		l.values = l.values&^v.mask | v.bits&v.mask
+	default:
+		return unix.ENOTTY
+	}
+	return nil
+}
+
+// line returns the request for the fd, releasing any requests whose
+// fd has been closed. The lock must be held.
+func (f *fakeChip) line(fd uintptr) *fakeLine {
+	for rfd, l := range f.reqs {
+		var st unix.Stat_t
+		if err := unix.Fstat(rfd, &st); err != nil || st.Ino != l.ino {
+			for _, o := range l.offsets {
+				delete(f.held, o)
+			}
+			unix.Close(l.wfd)
+			delete(f.reqs, rfd)
+		}
+	}
+	return f.reqs[int(fd)]
+}
+
+// request returns the request holding the offset.
+func (f *fakeChip) request(offset int) *fakeLine {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.line(0)
+	for _, l := range f.reqs {
+		for _, o := range l.offsets {
+			if o == offset {
+				return l
+			}
+		}
+	}
+	f.t.Fatalf("offset %d not requested", offset)
+	return nil
+}
+
+// setValues sets the values of an input request.
+func (f *fakeChip) setValues(offset int, v uint64) {
+	l := f.request(offset)
+	f.mu.Lock()
+	l.values = v
+	f.mu.Unlock()
+}
+
+func TestChipRequest(t *testing.T) {
+	f := newFakeChip(t, 8)
+	c, err := OpenChip(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.Name() != "gpiochip0" || c.Label() != "fake" || c.NumLines() != 8 {
+		t.Errorf("chip info: got %q %q %d", c.Name(), c.Label(), c.NumLines())
+	}
+	if n, err := c.LineName(3); err != nil || n != "L3" {
+		t.Errorf("LineName(3): got %q, %v", n, err)
+	}
+	l, err := c.Pin(3, Bias(BiasPullUp), ActiveLow(), Consumer("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := uint64(gpioV2FlagInput | gpioV2FlagPullUp | gpioV2FlagActiveLow)
+	if r := f.request(3); r.flags != want {
+		t.Errorf("request flags: got 0x%x, want 0x%x", r.flags, want)
+	}
+	_, err = c.Pin(3)
+	var be *BusyError
+	if !errors.As(err, &be) || be.Consumer != "test" {
+		t.Errorf("second request: got %v, want BusyError held by test", err)
+	}
+	if _, err := c.Pin(8); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("Pin(8): got %v, want ErrInvalid", err)
+	}
+	l.Close()
+	l, err = c.Pin(3)
+	if err != nil {
+		t.Fatalf("request after close: %v", err)
+	}
+	l.Close()
+}
+
+func TestLineConfig(t *testing.T) {
+	f := newFakeChip(t, 8)
+	l, err := ChipOutputPin(0, 1, Drive(DriveOpenDrain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	r := f.request(1)
+	if want := uint64(gpioV2FlagOutput | gpioV2FlagOpenDrain); r.flags != want {
+		t.Errorf("output flags: got 0x%x, want 0x%x", r.flags, want)
+	}
+	if err := l.Edge(RISING); !errors.Is(err, ErrNotInput) {
+		t.Errorf("Edge on output: got %v, want ErrNotInput", err)
+	}
+	if err := l.Direction(IN); err != nil {
+		t.Fatal(err)
+	}
+	// The drive mode is dropped for inputs.
+	if want := uint64(gpioV2FlagInput); r.flags != want {
+		t.Errorf("input flags: got 0x%x, want 0x%x", r.flags, want)
+	}
+	if err := l.Edge(BOTH); err != nil {
+		t.Fatal(err)
+	}
+	if want := uint64(gpioV2FlagInput | gpioV2FlagEdgeRising | gpioV2FlagEdgeFalling); r.flags != want {
+		t.Errorf("edge flags: got 0x%x, want 0x%x", r.flags, want)
+	}
+	if err := l.Direction(OUT); err != nil {
+		t.Fatal(err)
+	}
+	if want := uint64(gpioV2FlagOutput | gpioV2FlagOpenDrain); r.flags != want {
+		t.Errorf("output flags: got 0x%x, want 0x%x", r.flags, want)
+	}
+	if err := l.Direction(5); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("Direction(5): got %v, want ErrInvalid", err)
+	}
+}
+
+func TestLineValues(t *testing.T) {
+	f := newFakeChip(t, 8)
+	out, err := ChipOutputPin(0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	in, err := ChipPin(0, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	if err := out.Set(1); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := out.Get(); err != nil || v != 1 {
+		t.Errorf("output Get: got %d, %v, want 1", v, err)
+	}
+	if err := out.Set(2); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("Set(2): got %v, want ErrInvalid", err)
+	}
+	if err := in.Set(1); !errors.Is(err, ErrNotOutput) {
+		t.Errorf("Set on input: got %v, want ErrNotOutput", err)
+	}
+	for _, v := range []int{1, 0, 1} {
+		f.setValues(5, uint64(v))
+		if got, err := in.Get(); err != nil || got != v {
+			t.Errorf("input Get: got %d, %v, want %d", got, err, v)
+		}
+	}
+}
+
+// edge queues an edge event on the request holding the offset.
+func (f *fakeChip) edge(offset int, id uint32, seq uint32) {
+	l := f.request(offset)
+	ev := gpio_v2_line_event{timestamp_ns: uint64(seq) * 1000, id: id, offset: uint32(offset), line_seqno: seq}
+	b := (*[gpioEventSize]byte)(unsafe.Pointer(&ev))
+	if _, err := unix.Write(l.wfd, b[:]); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+func TestLineEventsClose(t *testing.T) {
+	f := newFakeChip(t, 8)
+	l, err := ChipPin(0, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Edge(BOTH); err != nil {
+		t.Fatal(err)
+	}
+	c, err := l.Events(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.edge(4, gpioV2EventRising, 1)
+	select {
+	case e := <-c:
+		if e.Edge != RISING || e.Level != 1 || e.Seq != 1 {
+			t.Errorf("event: got %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+	}
+	werr := make(chan error)
+	go func() {
+		_, err := l.GetTimeout(0)
+		werr <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	l.Close()
+	select {
+	case _, ok := <-c:
+		if ok {
+			t.Error("event after close")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("events channel not closed by Close")
+	}
+	select {
+	case err := <-werr:
+		if !errors.Is(err, os.ErrClosed) {
+			t.Errorf("GetTimeout after close: got %v, want ErrClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("GetTimeout not woken by Close")
+	}
+	if _, err := l.Events(context.Background()); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Events after close: got %v, want ErrClosed", err)
+	}
+}
+
+func TestLineCloseTwice(t *testing.T) {
+	f := newFakeChip(t, 8)
+	l, err := ChipPin(0, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	l2, err := ChipPin(0, 4)
+	if err != nil {
+		t.Fatalf("request after close: %v", err)
+	}
+	defer l2.Close()
+	// A second close must not release the new request.
+	l.Close()
+	if _, err := ChipPin(0, 4); !errors.Is(err, ErrBusy) {
+		t.Errorf("request after double close: got %v, want ErrBusy", err)
+	}
+	f.setValues(4, 1)
+	if v, err := l2.Get(); err != nil || v != 1 {
+		t.Errorf("Get after double close: got %d, %v", v, err)
+	}
+}
+
+func TestLineEventsDropped(t *testing.T) {
+	f := newFakeChip(t, 8)
+	l, err := ChipPin(0, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := l.Edge(BOTH); err != nil {
+		t.Fatal(err)
+	}
+	c, err := l.Events(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Queue more edges than the channel holds without reading any.
+	const sent = eventQueueSize + 32
+	for i := 1; i <= sent; i++ {
+		f.edge(4, gpioV2EventRising, uint32(i))
+	}
+	// Wait until the edges have all been read from the line
+	// and the channel is full.
+	deadline := time.Now().Add(time.Second)
+	for {
+		n, err := unix.IoctlGetInt(l.fd, unix.TIOCINQ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 && len(c) == eventQueueSize {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("edges not read: %d bytes pending, %d queued", n, len(c))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	received := 0
+	for len(c) > 0 {
+		<-c
+		received++
+	}
+	f.edge(4, gpioV2EventFalling, sent+1)
+	for {
+		select {
+		case e := <-c:
+			if e.Seq <= sent {
+				received++
+				continue
+			}
+			if e.Dropped == 0 || e.Dropped != uint64(sent-received) {
+				t.Errorf("Dropped: got %d, want %d", e.Dropped, sent-received)
+			}
+			return
+		case <-time.After(time.Second):
+			t.Fatal("no event after draining the channel")
+		}
+	}
+}
+
+func TestChipLines(t *testing.T) {
+	f := newFakeChip(t, 8)
+	c, err := OpenChip(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Lines(2, []int{1, 2}); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("Lines(2): got %v, want ErrInvalid", err)
+	}
+	l, err := c.Lines(OUT, []int{6, 1, 2}, Drive(DriveOpenDrain), ActiveLow())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	r := f.request(1)
+	if want := uint64(gpioV2FlagOutput | gpioV2FlagOpenDrain | gpioV2FlagActiveLow); r.flags != want {
+		t.Errorf("flags: got 0x%x, want 0x%x", r.flags, want)
+	}
+	if len(r.offsets) != 3 || r.offsets[0] != 6 {
+		t.Errorf("offsets: got %v, want [6 1 2]", r.offsets)
+	}
+	if err := l.SetValues(0xFD); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := l.GetValues(); err != nil || v != 5 {
+		t.Errorf("GetValues: got %d, %v, want 5", v, err)
+	}
+	if _, err := c.Pin(2); !errors.Is(err, ErrBusy) {
+		t.Errorf("Pin of a grouped line: got %v, want ErrBusy", err)
+	}
+	in, err := c.Lines(IN, []int{3, 4}, Bias(BiasPullDown), Drive(DriveOpenSource))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	// The drive mode is dropped for inputs.
+	if want := uint64(gpioV2FlagInput | gpioV2FlagPullDown); f.request(3).flags != want {
+		t.Errorf("input flags: got 0x%x, want 0x%x", f.request(3).flags, want)
+	}
+}
+
+func TestLineDebounce(t *testing.T) {
+	f := newFakeChip(t, 8)
+	l, err := ChipPin(0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := l.Debounce(1500 * time.Microsecond); err != nil {
+		t.Fatal(err)
+	}
+	r := f.request(1)
+	if len(r.attrs) != 1 || r.attrs[0].attr.id != gpioV2AttrDebounce || r.attrs[0].mask != 1 {
+		t.Fatalf("attributes: got %+v", r.attrs)
+	}
+	// The period is a u32 at the start of the attribute union.
+	if us := *(*uint32)(unsafe.Pointer(&r.attrs[0].attr.value)); us != 1500 {
+		t.Errorf("debounce period: got %dus, want 1500us", us)
+	}
+}
+
+func TestLineSoftDebounce(t *testing.T) {
+	f := newFakeChip(t, 8)
+	f.noDebounce = true
+	l, err := ChipPin(0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := l.Edge(RISING); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Debounce(10 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if r := f.request(1); len(r.attrs) != 0 {
+		t.Errorf("attributes with software debounce: got %+v", r.attrs)
+	}
+	// A rising edge followed by an unsignalled fall is not reported.
+	f.setValues(1, 1)
+	f.edge(1, gpioV2EventRising, 1)
+	time.AfterFunc(3*time.Millisecond, func() { f.setValues(1, 0) })
+	if _, err := l.GetTimeout(50 * time.Millisecond); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("rising edge settling low: got %v, want ErrDeadlineExceeded", err)
+	}
+	f.setValues(1, 1)
+	f.edge(1, gpioV2EventRising, 2)
+	if v, err := l.GetTimeout(50 * time.Millisecond); err != nil || v != 1 {
+		t.Errorf("rising edge: got %d, %v, want 1", v, err)
+	}
+}
@@ -17,10 +17,11 @@
 package io
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"os"
 	"os/user"
+	"path/filepath"
 	"time"
 
 	"golang.org/x/sys/unix"
@@ -31,6 +32,42 @@ type Setter interface {
 	Set(int) error
 }
 
+// ValuesSetter is an interface for setting the outputs of a group of GPIOs
+// in a single operation. Bit n of the value is the output of GPIO n.
+type ValuesSetter interface {
+	SetValues(uint64) error
+}
+
+// Getter is an interface for reading an input value from a GPIO.
+// If edge detection is enabled, the calls wait for an edge before
+// returning the value.
+type Getter interface {
+	Get() (int, error)
+	GetTimeout(time.Duration) (int, error)
+}
+
+// ContextGetter is an interface for reading an input value from a GPIO,
+// where the wait for an edge can be cancelled via a context.
+type ContextGetter interface {
+	GetContext(context.Context) (int, error)
+}
+
+// EdgeGetter is an interface for reading the edge detection setting
+// of a GPIO.
+type EdgeGetter interface {
+	GetEdge() int
+}
+
+// GpioPin is the interface provided by the GPIO implementations, such as
+// the sysfs (Gpio) and character device (Line) pins.
+type GpioPin interface {
+	Setter
+	Getter
+	Direction(int) error
+	Edge(int) error
+	Close()
+}
+
 // Interface for PWM controllers
 type PWM interface {
 	Close()
@@ -44,12 +81,16 @@ const verifyTimeout = 2 * time.Second
 // and udev will change the group permissions on the exported files, but
 // this takes some time to do. If we try and access the files before
 // the file group/modes are changed, we will get a permission error.
-// This can be overridden.
+// This can be overridden, either globally by setting Verify, or per
+// pin using the VerifyStrategy option.
 var Verify = false
 
-var (
-	ErrRetriesExceeded = errors.New("retries exceeded")
-)
+// Root is prepended to all the sysfs and device paths used by the package.
+// It is empty by default, and may be set to a directory containing a
+// replica of the /sys and /dev trees (such as one created by the
+// sysfstest package) so that the package can be exercised without hardware.
+// Root should be set before any devices are opened.
+var Root = ""
 
 func init() {
 	// If the user is not root, enable Verify mode
@@ -59,6 +100,14 @@ func init() {
 	}
 }
 
+// rootPath returns the path with Root prepended.
+func rootPath(p string) string {
+	if Root == "" {
+		return p
+	}
+	return filepath.Join(Root, p)
+}
+
 // unexport writes a unit number to an unexport file.
 func unexport(f string, g int) error {
 	return writeFile(f, fmt.Sprintf("%d", g))
@@ -67,15 +116,15 @@ func unexport(f string, g int) error {
 // export will check for the existence of a file, and if it is
 // not writable, will write a unit number to an export file, and then
 // optionally wait for the file to appear and become writable.
-func export(f, expfile string, g int) error {
+func export(f, expfile string, g int, cfg *config) error {
 	// Check if directory and files already exist.
 	err := unix.Access(f, unix.W_OK|unix.R_OK)
 	if err == nil {
 		return nil
 	}
 	err = writeFile(expfile, fmt.Sprintf("%d", g))
-	if err == nil && Verify {
-		return verifyFile(f)
+	if err == nil {
+		return verifyFile(f, cfg.strategy(VerifyNone), cfg.verifyTimeout)
 	}
 	return err
 }
@@ -90,17 +139,3 @@ func writeFile(fname, s string) error {
 	_, err = f.Write([]byte(s))
 	return err
 }
-
-// Wait for file to become writable.
-func verifyFile(f string) error {
-	var tout time.Duration
-	sl := time.Millisecond
-	for tout = 0; tout < verifyTimeout; tout += sl {
-		err := unix.Access(f, unix.W_OK)
-		if err == nil {
-			return nil
-		}
-		time.Sleep(sl)
-	}
-	return fmt.Errorf("%s: not writable", f)
-}
@@ -0,0 +1,146 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Software debouncing of edge triggered inputs.
+
+package io
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// debounce filters edges in software. An edge is only reported once
+// the level has been stable for the debounce period.
+type debounce struct {
+	period time.Duration
+	stable int // Last level reported, or -1 if unknown
+}
+
+// Debouncer wraps a GpioPin so that edges reported by Get and GetTimeout
+// are debounced in software. This allows the debouncing to be used
+// with any GpioPin implementation, such as a simulated pin.
+// While debouncing, edge detection on the wrapped pin is set to BOTH, so
+// that the level of the pin is known when the edges have settled.
+type Debouncer struct {
+	GpioPin
+	edge int
+	db   debounce
+}
+
+// NewDebouncer creates a Debouncer for the pin with the period selected.
+// If the pin implements EdgeGetter, its current edge setting is kept.
+func NewDebouncer(pin GpioPin, period time.Duration) *Debouncer {
+	d := &Debouncer{GpioPin: pin, db: debounce{period: period, stable: -1}}
+	if eg, ok := pin.(EdgeGetter); ok && eg.GetEdge() != NONE {
+		d.Edge(eg.GetEdge())
+	}
+	return d
+}
+
+// Edge sets the edge detection on the pin.
+func (d *Debouncer) Edge(e int) error {
+	pe := e
+	if d.db.period != 0 && e != NONE {
+		pe = BOTH
+	}
+	err := d.GpioPin.Edge(pe)
+	if err == nil {
+		d.edge = e
+		d.db.stable = -1
+	}
+	return err
+}
+
+// GetEdge returns the edge detection setting of the pin.
+func (d *Debouncer) GetEdge() int {
+	return d.edge
+}
+
+// Get returns the current value of the pin.
+func (d *Debouncer) Get() (int, error) {
+	return d.GetTimeout(0)
+}
+
+// GetTimeout waits for a debounced edge if edge detection is enabled,
+// and returns the value of the pin.
+func (d *Debouncer) GetTimeout(tout time.Duration) (int, error) {
+	// Both edges are detected on the pin, so the level is known
+	// without reading it again.
+	return d.db.wait(d.edge, tout, d.GpioPin.GetTimeout, nil)
+}
+
+// wait waits for an edge using get, and then waits for the level to
+// settle. Edges that settle back to the previous level, or to a level
+// that does not match the edge selected, are discarded.
+// Only the edges selected may be signalled, so once no edges have been
+// seen for the debounce period the level is read again using read,
+// unless read is nil.
+// The settling period may extend the wait beyond the timeout.
+// If debouncing or edge detection is not enabled, get is called directly.
+func (d *debounce) wait(edge int, tout time.Duration, get func(time.Duration) (int, error), read func() (int, error)) (int, error) {
+	if d.period == 0 || edge == NONE {
+		return get(tout)
+	}
+	var deadline time.Time
+	if tout != 0 {
+		deadline = time.Now().Add(tout)
+	}
+	for {
+		wait := time.Duration(0)
+		if tout != 0 {
+			wait = time.Until(deadline)
+			if wait <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+		}
+		v, err := get(wait)
+		if err != nil {
+			return 0, err
+		}
+		// Wait until no edges are seen for the debounce period.
+		for {
+			nv, err := get(d.period)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			if err != nil {
+				return 0, err
+			}
+			v = nv
+		}
+		if read != nil {
+			v, err = read()
+			if err != nil {
+				return 0, err
+			}
+		}
+		switch edge {
+		case RISING:
+			if v == 1 {
+				return v, nil
+			}
+		case FALLING:
+			if v == 0 {
+				return v, nil
+			}
+		default:
+			if v != d.stable {
+				d.stable = v
+				return v, nil
+			}
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package io_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aamcrae/gpio"
+	"github.com/aamcrae/gpio/sim"
+)
+
+const period = 20 * time.Millisecond
+
+// A bounce pattern is a list of levels, each driven for 1ms.
+var (
+	clean       = []int{1}
+	bounceHigh  = []int{1, 0, 1, 0, 1, 0, 1}
+	bounceLow   = []int{0, 1, 0, 1, 0, 1, 0}
+	glitchHigh  = []int{1, 0}
+	burstToLow  = []int{1, 0, 1, 0}
+	burstToHigh = []int{0, 1, 0, 1}
+)
+
+// testPin returns a debounced simulated input, starting at the level.
+func testPin(t *testing.T, level, edge int) (*sim.Chip, *io.Debouncer) {
+	c := sim.NewChip(1)
+	p, err := c.Pin(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+	c.Drive(0, level)
+	d := io.NewDebouncer(p, period)
+	if err := d.Edge(edge); err != nil {
+		t.Fatal(err)
+	}
+	return c, d
+}
+
+// drive drives the bounce pattern on the pin after a short delay.
+func drive(c *sim.Chip, pattern []int) {
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		for _, v := range pattern {
+			c.Drive(0, v)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+}
+
+func TestDebounce(t *testing.T) {
+	tests := []struct {
+		name    string
+		start   int
+		edge    int
+		pattern []int
+		want    int // Level reported, or -1 for no edge
+	}{
+		{"clean rising", 0, io.RISING, clean, 1},
+		{"bouncing rising", 0, io.RISING, bounceHigh, 1},
+		{"glitch rising", 0, io.RISING, glitchHigh, -1},
+		{"rising burst settling low", 0, io.RISING, burstToLow, -1},
+		{"bouncing falling", 1, io.FALLING, bounceLow, 0},
+		{"falling burst settling high", 1, io.FALLING, burstToHigh, -1},
+		{"bouncing both", 0, io.BOTH, bounceHigh, 1},
+		{"both burst settling low", 1, io.BOTH, burstToLow, 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c, d := testPin(t, tc.start, tc.edge)
+			drive(c, tc.pattern)
+			start := time.Now()
+			v, err := d.GetTimeout(100 * time.Millisecond)
+			if tc.want < 0 {
+				if !errors.Is(err, os.ErrDeadlineExceeded) {
+					t.Errorf("got %d, %v, want no edge", v, err)
+				}
+				return
+			}
+			if err != nil || v != tc.want {
+				t.Fatalf("got %d, %v, want %d", v, err, tc.want)
+			}
+			if d := time.Since(start); d < period {
+				t.Errorf("reported after %v, before the debounce period", d)
+			}
+		})
+	}
+}
+
+func TestDebounceBoth(t *testing.T) {
+	c, d := testPin(t, 0, io.BOTH)
+	for i, s := range []struct {
+		pattern []int
+		want    int // Level reported, or -1 for no edge
+	}{{bounceHigh, 1}, {bounceLow, 0}, {glitchHigh, -1}, {bounceHigh, 1}, {[]int{0, 1}, -1}} {
+		drive(c, s.pattern)
+		v, err := d.GetTimeout(100 * time.Millisecond)
+		if s.want < 0 {
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Errorf("pattern %d: got %d, %v, want no edge", i, v, err)
+			}
+		} else if err != nil || v != s.want {
+			t.Errorf("pattern %d: got %d, %v, want %d", i, v, err, s.want)
+		}
+	}
+}
+
+func TestDebouncerEdge(t *testing.T) {
+	c := sim.NewChip(1)
+	p, err := c.Pin(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if err := p.Edge(io.RISING); err != nil {
+		t.Fatal(err)
+	}
+	d := io.NewDebouncer(p, period)
+	if d.GetEdge() != io.RISING {
+		t.Errorf("GetEdge: got %d, want RISING", d.GetEdge())
+	}
+	// Both edges are detected on the wrapped pin.
+	if p.GetEdge() != io.BOTH {
+		t.Errorf("pin edge: got %d, want BOTH", p.GetEdge())
+	}
+	drive(c, bounceHigh)
+	if v, err := d.GetTimeout(100 * time.Millisecond); err != nil || v != 1 {
+		t.Errorf("got %d, %v, want 1", v, err)
+	}
+}
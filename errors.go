@@ -0,0 +1,121 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Error types carrying the device and operation.
+
+package io
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	ErrRetriesExceeded = errors.New("retries exceeded")
+	ErrNotSupported    = errors.New("not supported")
+	ErrBusy            = errors.New("resource busy")
+	ErrNotOutput       = errors.New("not an output")
+	ErrNotInput        = errors.New("not an input")
+	ErrNoEdge          = errors.New("edge detection not enabled")
+	ErrNoAck           = errors.New("no acknowledge from device")
+	ErrPec             = errors.New("packet error check failed")
+	ErrTimeout         = os.ErrDeadlineExceeded
+	ErrDiverged        = errors.New("transaction diverged from recording") // Replay does not match the recording
+)
+
+// PinError records an error and the pin and operation that caused it.
+type PinError struct {
+	Pin string // Pin name e.g "gpio17", "gpiochip0/17", "pwm0"
+	Op  string // Operation e.g "export", "direction", "set"
+	Err error
+}
+
+func (e *PinError) Error() string {
+	return e.Pin + ": " + e.Op + ": " + e.Err.Error()
+}
+
+func (e *PinError) Unwrap() error {
+	return e.Err
+}
+
+// Is allows the errno to be matched against the sentinel errors.
+func (e *PinError) Is(target error) bool {
+	return errnoIs(e.Err, target)
+}
+
+// BusError records an error and the bus, device address and operation
+// that caused it.
+type BusError struct {
+	Bus  string // Bus name e.g "i2c-1", "spidev0.1"
+	Addr int    // Device address, or -1 if none
+	Op   string // Operation e.g "read", "transfer"
+	Err  error
+}
+
+func (e *BusError) Error() string {
+	if e.Addr < 0 {
+		return e.Bus + ": " + e.Op + ": " + e.Err.Error()
+	}
+	return fmt.Sprintf("%s addr 0x%02x: %s: %v", e.Bus, e.Addr, e.Op, e.Err)
+}
+
+func (e *BusError) Unwrap() error {
+	return e.Err
+}
+
+// Is allows the errno to be matched against the sentinel errors.
+func (e *BusError) Is(target error) bool {
+	return errnoIs(e.Err, target)
+}
+
+// pinError returns a PinError, or nil if err is nil.
+// An error that is already a PinError is returned unchanged.
+func pinError(pin, op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*PinError); ok {
+		return err
+	}
+	return &PinError{Pin: pin, Op: op, Err: err}
+}
+
+// busError returns a BusError, or nil if err is nil.
+func busError(bus string, addr int, op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &BusError{Bus: bus, Addr: addr, Op: op, Err: err}
+}
+
+// errnoIs maps the errnos returned by the drivers to the sentinel errors.
+func errnoIs(err, target error) bool {
+	var errno unix.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	switch target {
+	case ErrNoAck:
+		// I2C adapters report a missing acknowledge as ENXIO or EREMOTEIO.
+		return errno == unix.ENXIO || errno == unix.EREMOTEIO
+	case ErrTimeout:
+		return errno == unix.ETIMEDOUT
+	case ErrBusy:
+		return errno == unix.EBUSY
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package io
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestErrnoIs(t *testing.T) {
+	tests := []struct {
+		err    error
+		target error
+		want   bool
+	}{
+		{unix.ENXIO, ErrNoAck, true},
+		{unix.EREMOTEIO, ErrNoAck, true},
+		{unix.EIO, ErrNoAck, false},
+		{unix.ETIMEDOUT, ErrTimeout, true},
+		{unix.ETIMEDOUT, ErrNoAck, false},
+		{unix.EBUSY, ErrBusy, true},
+		{unix.EAGAIN, ErrBusy, false},
+		{unix.EBUSY, ErrNotSupported, false},
+		{fmt.Errorf("ioctl: %w", unix.EREMOTEIO), ErrNoAck, true},
+		{errors.New("no errno"), ErrNoAck, false},
+	}
+	for _, tc := range tests {
+		if got := errnoIs(tc.err, tc.target); got != tc.want {
+			t.Errorf("errnoIs(%v, %v): got %v, want %v", tc.err, tc.target, got, tc.want)
+		}
+		pe := pinError("gpio4", "set", tc.err)
+		if got := errors.Is(pe, tc.target); got != tc.want {
+			t.Errorf("errors.Is(%v, %v): got %v, want %v", pe, tc.target, got, tc.want)
+		}
+		be := busError("i2c-1", 0x48, "read", tc.err)
+		if got := errors.Is(be, tc.target); got != tc.want {
+			t.Errorf("errors.Is(%v, %v): got %v, want %v", be, tc.target, got, tc.want)
+		}
+		// The errno itself is also matched.
+		if !errors.Is(be, tc.err) {
+			t.Errorf("errors.Is(%v, %v): got false", be, tc.err)
+		}
+	}
+}
+
+func TestErrorTypes(t *testing.T) {
+	err := fmt.Errorf("probe: %w", busError("i2c-1", 0x48, "read", unix.ENXIO))
+	var be *BusError
+	if !errors.As(err, &be) || be.Bus != "i2c-1" || be.Addr != 0x48 || be.Op != "read" {
+		t.Errorf("errors.As BusError: got %+v", be)
+	}
+	var errno unix.Errno
+	if !errors.As(err, &errno) || errno != unix.ENXIO {
+		t.Errorf("errors.As Errno: got %v", errno)
+	}
+	if s := be.Error(); s != "i2c-1 addr 0x48: read: "+unix.ENXIO.Error() {
+		t.Errorf("BusError: got %q", s)
+	}
+	if s := busError("spidev0.1", -1, "transfer", os.ErrClosed).Error(); s != "spidev0.1: transfer: "+os.ErrClosed.Error() {
+		t.Errorf("BusError without address: got %q", s)
+	}
+	// A PinError is not wrapped again.
+	pe := pinError("gpio4", "read", os.ErrClosed)
+	if err := pinError("gpio4", "get", pe); err != pe {
+		t.Errorf("pinError of a PinError: got %v, want %v", err, pe)
+	}
+	var p *PinError
+	if !errors.As(fmt.Errorf("wrapped: %w", pe), &p) || p.Pin != "gpio4" || p.Op != "read" || !errors.Is(p, os.ErrClosed) {
+		t.Errorf("errors.As PinError: got %+v", p)
+	}
+	if pinError("gpio4", "read", nil) != nil || busError("i2c-1", 0, "read", nil) != nil {
+		t.Error("nil error not returned as nil")
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package io
+
+import (
+	"context"
+	"time"
+)
+
+const eventQueueSize = 64 // Size of queue for edge events
+
+// Event is an edge event detected on an input pin.
+type Event struct {
+	Edge  int           // RISING or FALLING
+	Level int           // Level of the pin after the edge
+	Time  time.Duration // Timestamp from the monotonic clock
+	Seq   uint64        // Sequence number of the event
+	// Dropped is the total number of events that have been discarded
+	// because the event channel was full, counted from when the
+	// channel was created. A change in Dropped between successive events
+	// indicates that events have been lost. Events discarded by the kernel
+	// show up as gaps in Seq.
+	Dropped uint64
+}
+
+// eventReader waits for and returns the pending edge events.
+type eventReader func(p *ctxPoller) ([]Event, error)
+
+// runEvents starts a goroutine that reads events and sends them on a channel.
+// The channel is closed when the context is done, the pin is closed
+// or an error occurs.
+// If the channel is full, new events are discarded and counted.
+func runEvents(ctx context.Context, ps *pollers, fd int, events int16, read eventReader) (<-chan Event, error) {
+	p, err := newCtxPoller(ctx, ps, fd, events)
+	if err != nil {
+		return nil, err
+	}
+	c := make(chan Event, eventQueueSize)
+	go func() {
+		defer close(c)
+		defer p.close()
+		var dropped uint64
+		for {
+			evs, err := read(p)
+			if err != nil {
+				return
+			}
+			for _, e := range evs {
+				e.Dropped = dropped
+				select {
+				case c <- e:
+				default:
+					dropped++
+				}
+			}
+		}
+	}()
+	return c, nil
+}
@@ -17,11 +17,10 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
 	"flag"
 	"fmt"
 	"log"
+	"os"
 	"time"
 
 	"github.com/aamcrae/gpio"
@@ -31,6 +30,8 @@ const spiPotStages = 257
 
 var bus = flag.Int("bus", 1, "I2C bus number")
 var addr = flag.Int("addr", 0x77, "I2C device address")
+var record = flag.String("record", "", "Record the I2C transactions to this file")
+var replay = flag.String("replay", "", "Replay the I2C transactions from this file instead of using the bus")
 
 type cal_params struct {
 	AC1 int16
@@ -46,49 +47,90 @@ type cal_params struct {
 	MD  int16
 }
 
+// openBus opens the I2C bus, optionally recording or replaying the transactions.
+func openBus() (*io.I2C, error) {
+	switch {
+	case *replay != "":
+		f, err := os.Open(*replay)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r, err := io.NewI2cReplay(f)
+		if err != nil {
+			return nil, err
+		}
+		return io.NewI2cTransport(r, *replay)
+	case *record != "":
+		t, err := io.OpenI2cTransport(*bus)
+		if err != nil {
+			return nil, err
+		}
+		f, err := os.Create(*record)
+		if err != nil {
+			t.Close()
+			return nil, err
+		}
+		return io.NewI2cTransport(io.NewI2cRecorder(t, f), fmt.Sprintf("i2c-%d", *bus))
+	}
+	return io.NewI2C(*bus)
+}
+
 func main() {
 	flag.Parse()
-	i2, err := io.NewI2C(*bus)
+	i2, err := openBus()
 	if err != nil {
 		log.Fatalf("I2C bus %d: %v", *bus, err)
 	}
-	defer i2.Close()
-	i2.Addr(0x77)
+	if err := i2.Addr(uint16(*addr)); err != nil {
+		log.Fatalf("I2C bus %d: %v", *bus, err)
+	}
+	// Calibration data is a block of big endian 16 bit registers,
+	// which is read in one transfer.
 	b := make([]byte, 22)
-	err = i2.Read(0xAA, b)
-	if err != nil {
-		log.Fatal("I2C bus %d, message: %v", *bus, err)
+	if err := i2.Read(0xAA, b); err != nil {
+		log.Fatalf("I2C bus %d, calibration: %v", *bus, err)
+	}
+	p := cal_params{
+		AC1: io.S16BE(b[0:]),
+		AC2: io.S16BE(b[2:]),
+		AC3: io.S16BE(b[4:]),
+		AC4: io.U16BE(b[6:]),
+		AC5: io.U16BE(b[8:]),
+		AC6: io.U16BE(b[10:]),
+		B1:  io.S16BE(b[12:]),
+		B2:  io.S16BE(b[14:]),
+		MB:  io.S16BE(b[16:]),
+		MC:  io.S16BE(b[18:]),
+		MD:  io.S16BE(b[20:]),
 	}
-	// Data is big endian.
-	buf := bytes.NewReader(b)
-	var p cal_params
-	binary.Read(buf, binary.BigEndian, &p.AC1)
-	binary.Read(buf, binary.BigEndian, &p.AC2)
-	binary.Read(buf, binary.BigEndian, &p.AC3)
-	binary.Read(buf, binary.BigEndian, &p.AC4)
-	binary.Read(buf, binary.BigEndian, &p.AC5)
-	binary.Read(buf, binary.BigEndian, &p.AC6)
-	binary.Read(buf, binary.BigEndian, &p.B1)
-	binary.Read(buf, binary.BigEndian, &p.B2)
-	binary.Read(buf, binary.BigEndian, &p.MB)
-	binary.Read(buf, binary.BigEndian, &p.MC)
-	binary.Read(buf, binary.BigEndian, &p.MD)
 	fmt.Printf("AC6 = %d, AC5 = %d, MC = %d, MD = %d\n", p.AC6, p.AC5, p.MC, p.MD)
-	i2.WriteReg(0xF4, 0x2E)
+	if err := i2.WriteReg(0xF4, 0x2E); err != nil {
+		log.Fatalf("I2C bus %d, start temperature: %v", *bus, err)
+	}
 	time.Sleep(5 * time.Millisecond)
-	b = make([]byte, 2)
-	i2.Read(0xF6, b)
-	UT := binary.BigEndian.Uint16(b)
+	UT, err := i2.ReadU16BE(0xF6)
+	if err != nil {
+		log.Fatalf("I2C bus %d, temperature: %v", *bus, err)
+	}
 	oss := byte(0)
-	i2.WriteReg(0xF4, 0x34+(oss<<6))
+	if err := i2.WriteReg(0xF4, 0x34+(oss<<6)); err != nil {
+		log.Fatalf("I2C bus %d, start pressure: %v", *bus, err)
+	}
 	time.Sleep(5 * time.Millisecond)
-	b = make([]byte, 3)
-	i2.Read(0xF6, b)
-	UP := ((uint(b[0]) << 16) | (uint(b[1]) << 8) | uint(b[2])) >> (8 - oss)
+	up, err := i2.ReadU24(0xF6)
+	if err != nil {
+		log.Fatalf("I2C bus %d, pressure: %v", *bus, err)
+	}
+	UP := up >> (8 - oss)
 	x1 := int((int64(UT) - int64(p.AC6)) * int64(p.AC5) / (1 << 15))
 	x2 := int(p.MC) * (1 << 11) / (int(x1) + int(p.MD))
 	b5 := x1 + x2
 	t := (b5 + 8) / (1 << 4)
 	fmt.Printf("t = %d, UP = %d, UT = %d, b5 = %d, x1 = %d, x2 = %d\n", t, UP, UT, b5, x1, x2)
 	fmt.Printf("Temperature = %.1f degrees\n", float64(t)/10)
+	// Closing a replay reports whether all the transactions matched.
+	if err := i2.CloseErr(); err != nil {
+		log.Fatalf("I2C bus %d: %v", *bus, err)
+	}
 }
@@ -0,0 +1,63 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Scan an I2C bus and print a grid of the addresses that respond,
+// in the same format as i2cdetect.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/aamcrae/gpio"
+)
+
+var bus = flag.Int("bus", 1, "I2C bus number")
+
+func main() {
+	flag.Parse()
+	i2, err := io.NewI2C(*bus)
+	if err != nil {
+		log.Fatalf("I2C bus %d: %v", *bus, err)
+	}
+	defer i2.Close()
+	fmt.Print("    ")
+	for i := 0; i < 16; i++ {
+		fmt.Printf("  %x", i)
+	}
+	for addr := uint16(0); addr < 0x80; addr++ {
+		if addr%16 == 0 {
+			fmt.Printf("\n%02x:", addr)
+		}
+		if addr < io.I2cScanFirst || addr > io.I2cScanLast {
+			fmt.Print("   ")
+			continue
+		}
+		ok, err := i2.Probe(addr)
+		switch {
+		case errors.Is(err, io.ErrBusy):
+			fmt.Print(" UU")
+		case err != nil:
+			log.Fatalf("\nI2C bus %d: %v", *bus, err)
+		case ok:
+			fmt.Printf(" %02x", addr)
+		default:
+			fmt.Print(" --")
+		}
+	}
+	fmt.Println()
+}
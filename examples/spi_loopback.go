@@ -24,13 +24,25 @@ import (
 	"github.com/aamcrae/gpio"
 )
 
-var unit = flag.Int("spi", 0, "SPI Unit")
+var bus = flag.Int("bus", 0, "SPI bus")
+var cs = flag.Int("cs", 0, "SPI chip select")
+var list = flag.Bool("list", false, "List the SPI devices")
 
 func main() {
 	flag.Parse()
-	s, err := io.NewSpi(*unit)
+	if *list {
+		devs, err := io.SpiDevices()
+		if err != nil {
+			log.Fatalf("SPI devices: %v", err)
+		}
+		for _, d := range devs {
+			fmt.Printf("spidev%d.%d\n", d.Bus, d.Cs)
+		}
+		return
+	}
+	s, err := io.OpenSpi(*bus, *cs)
 	if err != nil {
-		log.Fatalf("Spi unit %d: %v", *unit, err)
+		log.Fatalf("Spi %d.%d: %v", *bus, *cs, err)
 	}
 	wr_data := []byte{
 		0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF,
@@ -13,7 +13,7 @@
 // limitations under the License.
 
 // Digital pot (MCP4151) example for SPI.
-// 3 Wire I/O is used for this device.
+// 3 Wire I/O is used for this device, with the SDI/SDO pin connected to MOSI.
 
 package main
 
@@ -28,15 +28,19 @@ import (
 
 const spiPotStages = 257
 
-var unit = flag.Int("spi", 0, "SPI Unit")
+var bus = flag.Int("bus", 0, "SPI bus")
+var cs = flag.Int("cs", 0, "SPI chip select")
 
 func main() {
 	flag.Parse()
-	s, err := io.NewSpi(*unit)
+	s, err := io.OpenSpi(*bus, *cs)
 	if err != nil {
-		log.Fatalf("Spi unit %d: %v", *unit, err)
+		log.Fatalf("Spi %d.%d: %v", *bus, *cs, err)
 	}
 	defer s.Close()
+	if err := s.Mode(io.SPI_MODE_0 | io.SPI_MODE_3WIRE); err != nil {
+		log.Fatalf("Spi %d.%d: %v", *bus, *cs, err)
+	}
 	for i := 0; i < spiPotStages; i++ {
 		Wr(s, i)
 	}
@@ -49,18 +53,23 @@ func Wr(s *io.Spi, v int) {
 	b := []byte{byte(v>>8) & 0x1, byte(v & 0xFF)}
 	_, err := s.Write(b)
 	if err != nil {
-		log.Fatalf("write: %v", *unit, err)
+		log.Fatalf("write: %v", err)
 	}
 	if v%32 == 0 {
-		// Read is 0x0C, but due to 3 wire protocol, other
-		// bits need to be set high so sensor can send data.
-		b[0] = 0x0F
-		b[1] = 0xFF
-		rb, err := s.Xfer(b)
+		// The read command is the address and command bits (0000 11),
+		// after which the device drives the data line with the 10 data
+		// bits (D9 to D0). The command is sent as a 6 bit word so that
+		// the line is released before the data bits, which are read as
+		// a 10 bit word (held in 2 bytes in CPU byte order, which is least
+		// significant byte first on the Raspberry Pi).
+		// The controller must support these word sizes.
+		rb := make([]byte, 2)
+		err := s.Transfer([]io.SpiTransfer{{Tx: []byte{0x03}, Bits: 6}, {Rx: rb, Bits: 10}})
 		if err != nil {
-			log.Fatalf("write: %v", *unit, err)
+			log.Fatalf("read: %v", err)
 		}
-		fmt.Printf("Rd = %02x%02x (%d)\n", rb[0], rb[1], (uint(rb[0]&1)<<8)+uint(rb[1]))
+		rv := (uint16(rb[1])<<8 | uint16(rb[0])) & 0x1FF
+		fmt.Printf("Rd = %03x (%d)\n", rv, rv)
 	}
 	time.Sleep(50 * time.Millisecond)
 }
@@ -17,8 +17,10 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"time"
 
 	"github.com/aamcrae/gpio"
 )
@@ -36,15 +38,13 @@ func main() {
 		log.Fatalf("Pin %d: edge BOTH: %v", *gpio, err)
 	}
 	defer p.Close()
-	last := -1
-	for {
-		v, err := p.Get()
-		if err != nil {
-			log.Fatalf("Pin %d: Get: %v", *gpio, err)
-		}
-		if v != last {
-			log.Printf("pin %d = %d\n", *gpio, v)
-			last = v
-		}
+	events, err := p.Events(context.Background())
+	if err != nil {
+		log.Fatalf("Pin %d: Events: %v", *gpio, err)
+	}
+	var last time.Duration
+	for e := range events {
+		log.Printf("pin %d = %d (seq %d, +%s, dropped %d)\n", *gpio, e.Level, e.Seq, e.Time-last, e.Dropped)
+		last = e.Time
 	}
 }
@@ -17,8 +17,13 @@
 package io
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"golang.org/x/sys/unix"
@@ -43,61 +48,182 @@ const (
 	gpioExportFile    = gpioBaseDir + "export"
 	gpioUnexportFile  = gpioBaseDir + "unexport"
 	gpioDirectionFile = "/direction"
+	gpioEdgeFile      = "/edge"
+	gpioActiveLowFile = "/active_low"
 	gpioValueFile     = "/value"
 )
 
 // Gpio represents one GPIO pin.
 type Gpio struct {
 	number    int
+	res       string // Name in the registry
 	value     *os.File
 	buf       []byte
 	direction int
 	edge      int
-	pollfd    []unix.PollFd
+	db        debounce
+	seq       uint64  // Sequence number of watched events
+	pollers   pollers // Pollers waiting for edges
+	safe      int     // Safe value
+	hasSafe   bool    // Safe value has been registered
 }
 
 // OutputPin opens a GPIO pin and sets the direction as OUTPUT.
-func OutputPin(gpio int) (*Gpio, error) {
-	g, err := Pin(gpio)
+func OutputPin(gpio int, opts ...Option) (*Gpio, error) {
+	return openPin(gpio, OUT, opts)
+}
+
+// Pin opens a GPIO pin as an input (by default)
+// The sysfs interface supports the ActiveLow option, but cannot
+// set the bias or drive mode of the pin.
+// A pin that is opened again with the same Consumer label shares the
+// first open, and must be opened with the same direction and ActiveLow
+// option, since the pin is not reconfigured.
+func Pin(gpio int, opts ...Option) (*Gpio, error) {
+	return openPin(gpio, IN, opts)
+}
+
+// openPin opens a GPIO pin with the direction.
+func openPin(gpio, dir int, opts []Option) (*Gpio, error) {
+	cfg, err := newConfig(opts)
 	if err != nil {
 		return nil, err
 	}
-	err = g.Direction(OUT)
-	if err != nil {
-		g.Close()
-		return nil, err
+	if cfg.bias != BiasAsIs {
+		return nil, &PinError{Pin: fmt.Sprintf("gpio%d", gpio), Op: "bias", Err: ErrNotSupported}
+	}
+	if cfg.drive != DrivePushPull {
+		return nil, &PinError{Pin: fmt.Sprintf("gpio%d", gpio), Op: "drive", Err: ErrNotSupported}
 	}
-	return g, nil
-}
-
-// Pin opens a GPIO pin as an input (by default)
-func Pin(gpio int) (*Gpio, error) {
 	g := new(Gpio)
 	g.number = gpio
 	g.buf = make([]byte, 1)
 
-	vFile := fmt.Sprintf("%sgpio%d%s", gpioBaseDir, gpio, gpioValueFile)
-	err := export(vFile, gpioExportFile, gpio)
+	// Opens of the same pin with the same Consumer label share the
+	// export, so that the pin is only unexported on the last close.
+	g.res = gpioResource(gpio)
+	first, err := reserveRef(g.res, cfg.consumer, cfg.consumerSet)
 	if err != nil {
 		return nil, err
 	}
-	err = g.Direction(IN)
+	vFile := rootPath(fmt.Sprintf("%sgpio%d%s", gpioBaseDir, gpio, gpioValueFile))
+	if first {
+		err = export(vFile, rootPath(gpioExportFile), gpio, cfg)
+		if err != nil {
+			release(g.res)
+			return nil, pinError(g.resource(), "export", err)
+		}
+		err = g.configure(dir, cfg)
+	} else {
+		err = g.current(dir, cfg)
+	}
 	if err != nil {
-		unexport(gpioUnexportFile, gpio)
+		g.release()
 		return nil, err
 	}
+	g.value, err = os.OpenFile(vFile, os.O_RDWR, 0600)
+	if err != nil {
+		g.release()
+		return nil, pinError(g.resource(), "open", err)
+	}
+	return g, nil
+}
+
+// configure sets up a newly exported pin.
+func (g *Gpio) configure(dir int, cfg *config) error {
+	err := g.activeLow(cfg.activeLow)
+	if err != nil {
+		return pinError(g.resource(), "active low", err)
+	}
+	err = g.Direction(IN)
+	if err != nil {
+		return err
+	}
 	err = g.Edge(NONE)
 	if err != nil {
-		unexport(gpioUnexportFile, gpio)
-		return nil, err
+		return err
 	}
-	g.value, err = os.OpenFile(fmt.Sprintf("%sgpio%d%s", gpioBaseDir, gpio, gpioValueFile), os.O_RDWR, 0600)
+	if dir == OUT {
+		return g.Direction(OUT)
+	}
+	return nil
+}
+
+// current reads the settings of a pin that is already held, which a
+// shared open does not change. ErrBusy is returned if the settings
+// do not match those requested.
+func (g *Gpio) current(dir int, cfg *config) error {
+	al, err := g.attr(gpioActiveLowFile)
 	if err != nil {
-		unexport(gpioUnexportFile, gpio)
-		return nil, err
+		return pinError(g.resource(), "active low", err)
 	}
-	g.pollfd = []unix.PollFd{{int32(g.value.Fd()), unix.POLLIN | unix.POLLPRI | unix.POLLERR, 0}}
-	return g, nil
+	if (al == "1") != cfg.activeLow {
+		return pinError(g.resource(), "active low", ErrBusy)
+	}
+	d, err := g.attr(gpioDirectionFile)
+	if err != nil {
+		return pinError(g.resource(), "direction", err)
+	}
+	switch d {
+	case "in":
+		g.direction = IN
+	case "out":
+		g.direction = OUT
+	default:
+		return pinError(g.resource(), "direction", fmt.Errorf("unknown direction %q", d))
+	}
+	if g.direction != dir {
+		return pinError(g.resource(), "direction", ErrBusy)
+	}
+	// The edge file is not present if the pin cannot interrupt.
+	e, err := g.attr(gpioEdgeFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return pinError(g.resource(), "edge", err)
+	}
+	switch e {
+	case "rising":
+		g.edge = RISING
+	case "falling":
+		g.edge = FALLING
+	case "both":
+		g.edge = BOTH
+	}
+	g.db.stable = -1
+	return nil
+}
+
+// attr reads an attribute file of the pin.
+func (g *Gpio) attr(name string) (string, error) {
+	b, err := os.ReadFile(rootPath(fmt.Sprintf("%sgpio%d%s", gpioBaseDir, g.number, name)))
+	return strings.TrimSpace(string(b)), err
+}
+
+// gpioResource returns the name of a sysfs GPIO in the registry.
+// This is the name of the character device line of the GPIO where the
+// line can be found, so that one line cannot be held through both
+// interfaces.
+func gpioResource(gpio int) string {
+	chips, _ := filepath.Glob(rootPath(gpioBaseDir + "gpiochip*"))
+	for _, c := range chips {
+		base, err := readInt(filepath.Join(c, "base"))
+		if err != nil {
+			continue
+		}
+		n, err := readInt(filepath.Join(c, "ngpio"))
+		if err != nil || gpio < base || gpio >= base+n {
+			continue
+		}
+		// The character device is a sibling of the sysfs chip
+		// under the parent device.
+		devs, _ := filepath.Glob(filepath.Join(c, "device", "gpiochip*"))
+		if len(devs) == 1 {
+			if chip, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(devs[0]), "gpiochip")); err == nil {
+				return lineResource(chip, gpio-base)
+			}
+		}
+		break
+	}
+	return fmt.Sprintf("gpio%d", gpio)
 }
 
 // Direction sets the mode (direction) of the GPIO pin.
@@ -109,19 +235,33 @@ func (g *Gpio) Direction(d int) error {
 	case OUT:
 		s = "out"
 	default:
-		return os.ErrInvalid
+		return pinError(g.resource(), "direction", os.ErrInvalid)
 	}
-	err := writeFile(fmt.Sprintf("%sgpio%d/direction", gpioBaseDir, g.number), s)
+	err := writeFile(rootPath(fmt.Sprintf("%sgpio%d%s", gpioBaseDir, g.number, gpioDirectionFile)), s)
 	if err == nil {
 		g.direction = d
 	}
-	return err
+	return pinError(g.resource(), "direction", err)
+}
+
+// activeLow sets or clears the inversion of the GPIO pin.
+func (g *Gpio) activeLow(inv bool) error {
+	s := "0"
+	if inv {
+		s = "1"
+	}
+	return writeFile(rootPath(fmt.Sprintf("%sgpio%d%s", gpioBaseDir, g.number, gpioActiveLowFile)), s)
+}
+
+// GetEdge returns the edge detection setting of the GPIO pin.
+func (g *Gpio) GetEdge() int {
+	return g.edge
 }
 
 // Edge sets the edge detection on the GPIO pin.
 func (g *Gpio) Edge(e int) error {
 	if g.direction != IN {
-		return fmt.Errorf("gpio%d: not set as an input pin", g.number)
+		return pinError(g.resource(), "edge", ErrNotInput)
 	}
 	var s string
 	switch e {
@@ -134,29 +274,30 @@ func (g *Gpio) Edge(e int) error {
 	case BOTH:
 		s = "both"
 	default:
-		return os.ErrInvalid
+		return pinError(g.resource(), "edge", os.ErrInvalid)
 	}
-	err := writeFile(fmt.Sprintf("%sgpio%d/edge", gpioBaseDir, g.number), s)
+	err := writeFile(rootPath(fmt.Sprintf("%sgpio%d%s", gpioBaseDir, g.number, gpioEdgeFile)), s)
 	if err == nil {
 		g.edge = e
+		g.db.stable = -1
 	}
-	return err
+	return pinError(g.resource(), "edge", err)
 }
 
 // Set the output of the GPIO pin (only valid for OUTPUT pins)
 func (g *Gpio) Set(v int) error {
 	if g.direction != OUT {
-		return fmt.Errorf("gpio%d: is not output", g.number)
+		return pinError(g.resource(), "set", ErrNotOutput)
 	}
 	if v == 0 {
 		g.buf[0] = '0'
 	} else if v == 1 {
 		g.buf[0] = '1'
 	} else {
-		return os.ErrInvalid
+		return pinError(g.resource(), "set", os.ErrInvalid)
 	}
 	_, err := g.value.WriteAt(g.buf, 0)
-	return err
+	return pinError(g.resource(), "set", err)
 }
 
 // Get returns the current value of the GPIO pin.
@@ -166,50 +307,189 @@ func (g *Gpio) Get() (int, error) {
 
 // GetTimeout is used when detecting edges, and a timeout is required.
 // A timeout of 0 is interpreted as no timeout.
+// If a debounce period is set, only debounced edges are reported.
 func (g *Gpio) GetTimeout(tout time.Duration) (int, error) {
-	if g.edge != NONE {
-		// Wait for edge using poll with optional timeout.
-		var tout_ms int
-		if tout == 0 {
-			tout_ms = -1
-		} else {
-			tout_ms = int(tout.Milliseconds())
+	v, err := g.getContext(context.Background(), tout)
+	return v, pinError(g.resource(), "get", err)
+}
+
+// GetContext is used when detecting edges, and waits for an edge
+// until the context is done, in which case the context error is returned.
+func (g *Gpio) GetContext(ctx context.Context) (int, error) {
+	v, err := g.getContext(ctx, 0)
+	return v, pinError(g.resource(), "get", err)
+}
+
+// Debounce sets the debounce period for edge detection, so that an
+// edge is only reported by Get or GetTimeout once the level has been stable
+// for the period. The sysfs interface has no kernel support for debouncing,
+// so edges are filtered in software. A period of 0 disables debouncing.
+// Events are not debounced.
+func (g *Gpio) Debounce(d time.Duration) error {
+	if d < 0 {
+		return pinError(g.resource(), "debounce", os.ErrInvalid)
+	}
+	g.db = debounce{period: d, stable: -1}
+	return nil
+}
+
+// getContext waits for an edge (if edge detection is enabled) and
+// returns the value of the pin.
+func (g *Gpio) getContext(ctx context.Context, tout time.Duration) (int, error) {
+	if g.edge == NONE {
+		return g.read(g.buf)
+	}
+	// The sysfs value file always polls as readable, so an edge is signalled
+	// by POLLPRI and POLLERR.
+	p, err := newCtxPoller(ctx, &g.pollers, int(g.value.Fd()), unix.POLLPRI|unix.POLLERR)
+	if err != nil {
+		return 0, err
+	}
+	defer p.close()
+	return g.db.wait(g.edge, tout, func(tout time.Duration) (int, error) {
+		_, err := p.wait(tout)
+		if err != nil {
+			return 0, err
 		}
-		for {
-			g.pollfd[0].Revents = 0
-			_, err := unix.Poll(g.pollfd, tout_ms)
-			switch err {
-			case nil:
-				// Successful call
-			case unix.EAGAIN:
-				continue
-			case unix.EINTR:
-				continue
-			default:
-				return 0, err
-			}
-			break
+		return g.read(g.buf)
+	}, func() (int, error) {
+		return g.read(g.buf)
+	})
+}
+
+// Events returns a channel of edge events detected on the pin.
+// Edge detection must be enabled via Edge before Events is called.
+// The channel is closed when the context is done or the pin is closed.
+// The sysfs interface does not supply a timestamp, so the events are
+// timestamped using the monotonic clock when the edge is detected.
+// GetTimeout should not be called while events are being read.
+func (g *Gpio) Events(ctx context.Context) (<-chan Event, error) {
+	if g.edge == NONE {
+		return nil, pinError(g.resource(), "events", ErrNoEdge)
+	}
+	// Read the value to clear any pending notification.
+	buf := make([]byte, 1)
+	_, err := g.read(buf)
+	if err != nil {
+		return nil, pinError(g.resource(), "events", err)
+	}
+	edge := g.edge
+	var seq uint64
+	c, err := runEvents(ctx, &g.pollers, int(g.value.Fd()), unix.POLLPRI|unix.POLLERR, func(p *ctxPoller) ([]Event, error) {
+		_, err := p.wait(0)
+		if err != nil {
+			return nil, err
+		}
+		seq++
+		e, err := g.edgeEvent(buf, edge, seq)
+		if err != nil {
+			return nil, err
 		}
-		// Check for timeout.
-		if tout != 0 && (g.pollfd[0].Revents&unix.POLLIN) == 0 {
-			return 0, os.ErrDeadlineExceeded
+		return []Event{e}, nil
+	})
+	return c, pinError(g.resource(), "events", err)
+}
+
+// edgeEvent reads the value of the pin after an edge has been detected,
+// and returns the edge event.
+func (g *Gpio) edgeEvent(buf []byte, edge int, seq uint64) (Event, error) {
+	t := monotonic()
+	v, err := g.read(buf)
+	if err != nil {
+		return Event{}, err
+	}
+	if edge == BOTH {
+		if v == 1 {
+			edge = RISING
+		} else {
+			edge = FALLING
 		}
 	}
-	_, err := g.value.ReadAt(g.buf, 0)
+	return Event{Edge: edge, Level: v, Time: t, Seq: seq}, nil
+}
+
+// WatchFd returns the file descriptor and epoll events used to watch the pin.
+func (g *Gpio) WatchFd() (int, uint32, error) {
+	if g.edge == NONE {
+		return 0, 0, pinError(g.resource(), "watch", ErrNoEdge)
+	}
+	// Clear any pending notification.
+	_, err := g.read(g.buf)
+	return int(g.value.Fd()), unix.EPOLLPRI | unix.EPOLLERR, pinError(g.resource(), "watch", err)
+}
+
+// WatchEvents returns the event for an edge detected by a Watcher.
+func (g *Gpio) WatchEvents() ([]Event, error) {
+	g.seq++
+	e, err := g.edgeEvent(g.buf, g.edge, g.seq)
 	if err != nil {
-		return 0, err
+		return nil, pinError(g.resource(), "watch", err)
 	}
-	if g.buf[0] == '0' {
+	return []Event{e}, nil
+}
+
+// read reads the current value of the pin using the buffer provided.
+func (g *Gpio) read(buf []byte) (int, error) {
+	_, err := g.value.ReadAt(buf, 0)
+	if err != nil {
+		return 0, pinError(g.resource(), "read", err)
+	}
+	if buf[0] == '0' {
 		return 0, nil
-	} else if g.buf[0] == '1' {
+	} else if buf[0] == '1' {
 		return 1, nil
 	} else {
-		return 0, fmt.Errorf("gpio%d: unknown value %s", g.number, g.buf)
+		return 0, pinError(g.resource(), "read", fmt.Errorf("unknown value %q", buf))
 	}
 }
 
-// Close the GPIO pin and unexport it.
+// Close the GPIO pin and unexport it, unless it is still
+// held by another open. Calls waiting for an edge on the pin
+// return os.ErrClosed, and channels returned by Events are closed.
 func (g *Gpio) Close() {
+	if g.hasSafe {
+		UnregisterSafe(g)
+		// The pin is left unchanged for the other opens.
+		if refs(g.res) == 1 {
+			g.Safe()
+		}
+	}
+	g.pollers.close()
 	g.value.Close()
-	unexport(gpioUnexportFile, g.number)
+	g.release()
+}
+
+// SafeValue registers the value that the pin is set to when
+// SafeState is called, or the pin is closed by the last open.
+func (g *Gpio) SafeValue(v int) error {
+	if v != 0 && v != 1 {
+		return pinError(g.resource(), "safe value", os.ErrInvalid)
+	}
+	g.safe = v
+	g.hasSafe = true
+	RegisterSafe(g)
+	return nil
+}
+
+// Safe sets the pin as an output with the safe value.
+func (g *Gpio) Safe() error {
+	if g.direction != OUT {
+		if err := g.Direction(OUT); err != nil {
+			return err
+		}
+	}
+	return g.Set(g.safe)
+}
+
+// release releases the pin from the registry, and unexports
+// it if this was the last reference.
+func (g *Gpio) release() {
+	if release(g.res) {
+		unexport(rootPath(gpioUnexportFile), g.number)
+	}
+}
+
+// resource returns the name of the pin used in errors.
+func (g *Gpio) resource() string {
+	return fmt.Sprintf("gpio%d", g.number)
 }
@@ -0,0 +1,87 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package io
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// waitPolling waits until a number of polls are waiting for an edge.
+func waitPolling(t *testing.T, polling func() int, n int) {
+	t.Helper()
+	for end := time.Now().Add(2 * time.Second); polling() != n; time.Sleep(time.Millisecond) {
+		if time.Now().After(end) {
+			t.Fatalf("timed out waiting for %d polls", n)
+		}
+	}
+}
+
+func TestPinEdge(t *testing.T) {
+	fs := newSysfs(t, "")
+	p, err := Pin(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if err := p.Edge(RISING); err != nil {
+		t.Fatal(err)
+	}
+	waitAttr(t, fs.Edge, 5, "rising")
+	type result struct {
+		v   int
+		err error
+	}
+	res := make(chan result)
+	go func() {
+		v, err := p.GetTimeout(time.Second)
+		res <- result{v, err}
+	}()
+	waitPolling(t, fs.Polling, 1)
+	fs.SetValue(5, 1)
+	if r := <-res; r.err != nil || r.v != 1 {
+		t.Errorf("rising edge: got %d, %v, want 1", r.v, r.err)
+	}
+	// A falling edge is not reported.
+	fs.SetValue(5, 0)
+	if _, err := p.GetTimeout(50 * time.Millisecond); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("falling edge: got %v, want ErrDeadlineExceeded", err)
+	}
+	if err := p.Edge(BOTH); err != nil {
+		t.Fatal(err)
+	}
+	waitAttr(t, fs.Edge, 5, "both")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	evs, err := p.Events(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []int{1, 0} {
+		waitPolling(t, fs.Polling, 1)
+		fs.SetValue(5, v)
+		select {
+		case e := <-evs:
+			if e.Level != v {
+				t.Errorf("event: got level %d, want %d", e.Level, v)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no event for level %d", v)
+		}
+	}
+}
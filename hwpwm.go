@@ -36,38 +36,60 @@ type HwPwm struct {
 	dFile  *os.File
 	period int64
 	duty   int64
+	safe   int // Safe duty cycle (percent), or -1 if not registered
 }
 
 // NewHwPWM creates a new hardware PWM controller.
-func NewHwPWM(unit int) (*HwPwm, error) {
+// The Consumer option may be used to label the unit in the registry, and
+// the VerifyStrategy and VerifyTimeout options control the waiting for
+// the exported files to become writable. The duty cycle file is waited
+// for even if Verify is not set, using inotify unless another strategy
+// is selected.
+func NewHwPWM(unit int, opts ...Option) (*HwPwm, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
 	p := new(HwPwm)
 	p.unit = unit
-	p.base = fmt.Sprintf("%spwm%d", pwmBaseDir, unit)
+	p.base = rootPath(fmt.Sprintf("%spwm%d", pwmBaseDir, unit))
 	p.period = -1
 	p.duty = -1
+	p.safe = -1
 
-	vFile := fmt.Sprintf("%s%s", p.base, periodFile)
-	err := export(vFile, pwmExportFile, unit)
+	err = reserve(p.resource(), cfg.consumer, false)
 	if err != nil {
 		return nil, err
 	}
-	p.pFile, err = os.OpenFile(fmt.Sprintf("%s%s", p.base, periodFile), os.O_RDWR, 0600)
+	vFile := fmt.Sprintf("%s%s", p.base, periodFile)
+	err = export(vFile, rootPath(pwmExportFile), unit, cfg)
 	if err != nil {
-		unexport(pwmUnexportFile, unit)
-		return nil, err
+		release(p.resource())
+		return nil, pinError(p.resource(), "export", err)
+	}
+	p.pFile, err = os.OpenFile(vFile, os.O_RDWR, 0600)
+	if err != nil {
+		unexport(rootPath(pwmUnexportFile), unit)
+		release(p.resource())
+		return nil, pinError(p.resource(), "open", err)
 	}
 	dName := fmt.Sprintf("%s%s", p.base, dutyFile)
-	err = verifyFile(dName)
+	// The duty cycle file may appear after the period file, so it is
+	// always verified unless verification is explicitly disabled, using
+	// inotify as pins do when Verify is set.
+	err = verifyFile(dName, cfg.strategy(VerifyInotify), cfg.verifyTimeout)
 	if err != nil {
 		p.pFile.Close()
-		unexport(pwmUnexportFile, unit)
-		return nil, err
+		unexport(rootPath(pwmUnexportFile), unit)
+		release(p.resource())
+		return nil, pinError(p.resource(), "open", err)
 	}
 	p.dFile, err = os.OpenFile(dName, os.O_RDWR, 0600)
 	if err != nil {
 		p.pFile.Close()
-		unexport(pwmUnexportFile, unit)
-		return nil, err
+		unexport(rootPath(pwmUnexportFile), unit)
+		release(p.resource())
+		return nil, pinError(p.resource(), "open", err)
 	}
 	// Default settings
 	p.Set(time.Millisecond*100, 0)
@@ -75,22 +97,60 @@ func NewHwPWM(unit int) (*HwPwm, error) {
 	if err != nil {
 		p.pFile.Close()
 		p.dFile.Close()
-		unexport(pwmUnexportFile, unit)
-		return nil, err
+		unexport(rootPath(pwmUnexportFile), unit)
+		release(p.resource())
+		return nil, pinError(p.resource(), "enable", err)
 	}
 	return p, nil
 }
 
 // Close closes the PWM controller
 func (p *HwPwm) Close() {
+	if p.safe >= 0 {
+		p.Safe()
+		UnregisterSafe(p)
+	}
 	writeFile(fmt.Sprintf("%s%s", p.base, enableFile), "0")
 	p.pFile.Close()
 	p.dFile.Close()
-	unexport(pwmUnexportFile, p.unit)
+	unexport(rootPath(pwmUnexportFile), p.unit)
+	release(p.resource())
+}
+
+// SafeDuty registers the duty cycle (as a percentage) that the PWM is
+// set to when SafeState is called, or the controller is closed.
+func (p *HwPwm) SafeDuty(duty int) error {
+	if duty < 0 || duty > 100 {
+		return pinError(p.resource(), "safe duty", os.ErrInvalid)
+	}
+	p.safe = duty
+	RegisterSafe(p)
+	return nil
+}
+
+// Safe sets the safe duty cycle, keeping the current period.
+func (p *HwPwm) Safe() error {
+	if p.safe < 0 {
+		return nil
+	}
+	period := time.Millisecond * 100
+	if p.period > 0 {
+		period = time.Duration(p.period)
+	}
+	return p.Set(period, p.safe)
+}
+
+// resource returns the name of the PWM unit in the registry.
+func (p *HwPwm) resource() string {
+	return fmt.Sprintf("pwm%d", p.unit)
 }
 
 // Set sets the PWM parameters.
 func (p *HwPwm) Set(period time.Duration, duty int) error {
+	return pinError(p.resource(), "set", p.set(period, duty))
+}
+
+func (p *HwPwm) set(period time.Duration, duty int) error {
 	if duty < 0 || duty > 100 {
 		return os.ErrInvalid
 	}
@@ -15,8 +15,10 @@
 package io
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"sync"
 	"time"
 	"unsafe"
 )
@@ -32,8 +34,9 @@ const I2cMaxMsgs = 42 // Maximum number of messages allowed in transaction
 
 // Flags
 const (
-	I2cFlagRead   = 1 << iota // Message is to be read, not written
-	I2cFlagTenBit             // Address is 10 bit address
+	I2cFlagRead    = 1 << iota // Message is to be read, not written
+	I2cFlagTenBit              // Address is 10 bit address
+	I2cFlagRecvLen             // First byte read is the length of the rest of the message
 )
 
 const i2cCode uintptr = 7
@@ -46,14 +49,46 @@ var (
 	i2cFuncs      uintptr = 0x0705
 	i2cSlaveForce uintptr = 0x0706
 	i2cRdWr       uintptr = 0x0707
+	i2cPec        uintptr = 0x0708
+	i2cSmbus      uintptr = 0x0720
 )
 
-// I2C represents one I2C device
+// I2C represents one I2C bus, or a handle for one device on the bus.
 type I2C struct {
-	bus   int
+	bus      int
+	label    string // Name of the bus if not a /dev/i2c device
+	adapter  i2cAdapter
+	addr     uint16 // Default address
+	funcs    uint32
+	consumer string
+	shared   bool // Consumer was set, so addresses may be shared
+	held     bool // Default address is reserved
+	pec      bool // Packet error checking enabled
+	device   bool // Device handle, the adapter is owned by the bus
+}
+
+// i2cAdapter performs the transfers and control requests for an I2C.
+// The bus must be locked for each transfer, SMBus command and control
+// request, so that the adapter may be shared by device handles in
+// separate goroutines, and so that a sequence of requests (such as
+// selecting a mux channel and then transferring on it) can be made
+// without other users of the bus interleaving.
+// The errors returned are not wrapped.
+type i2cAdapter interface {
+	lock()
+	unlock()
+	transfer(msgs []I2cMsg) error
+	smbus(addr uint16, pec bool, args *i2c_smbus_ioctl_data) error
+	control(req, arg uintptr) error
+	close() error
+}
+
+// i2cDev is the adapter for a /dev/i2c device.
+type i2cDev struct {
 	file  *os.File
-	addr  uint16 // Default address
-	funcs uint32
+	mu    sync.Mutex
+	slave int  // Address selected for SMBus transfers, or -1
+	pec   bool // Packet error checking selected for SMBus transfers
 }
 
 type i2c_rdwr struct {
@@ -70,49 +105,131 @@ type i2c_msg struct {
 }
 
 // NewI2C creates and initialises a new I2C device.
-func NewI2C(bus int) (*I2C, error) {
-	i2 := new(I2C)
-	i2.bus = bus
-	var err error
-	i2.file, err = os.OpenFile(fmt.Sprintf("/dev/i2c-%d", i2.bus), os.O_RDWR, 0600)
+// The Consumer option may be used to label the device addresses in the registry.
+func NewI2C(bus int, opts ...Option) (*I2C, error) {
+	cfg, err := newConfig(opts)
 	if err != nil {
 		return nil, err
 	}
-	var funcs uintptr
-	err = ioctl(i2.file.Fd(), i2cFuncs, uintptr(unsafe.Pointer(&funcs)))
+	i2 := new(I2C)
+	i2.bus = bus
+	i2.consumer = cfg.consumer
+	i2.shared = cfg.consumerSet
+	d, funcs, err := openI2cDev(i2.name())
 	if err != nil {
-		i2.Close()
 		return nil, err
 	}
-	i2.funcs = uint32(funcs)
+	i2.adapter = d
+	i2.funcs = funcs
 	i2.Timeout(time.Millisecond * 50)
 	i2.Retries(3)
 	return i2, nil
 }
 
-// Close closes the device.
+// openI2cDev opens the /dev/i2c device and reads the adapter functionality.
+func openI2cDev(name string) (*i2cDev, uint32, error) {
+	f, err := os.OpenFile(rootPath("/dev/"+name), os.O_RDWR, 0600)
+	if err != nil {
+		return nil, 0, busError(name, -1, "open", err)
+	}
+	d := &i2cDev{file: f, slave: -1}
+	var funcs uintptr
+	if err := d.control(i2cFuncs, uintptr(unsafe.Pointer(&funcs))); err != nil {
+		d.close()
+		return nil, 0, busError(name, -1, "funcs", err)
+	}
+	return d, uint32(funcs), nil
+}
+
+// Close closes the bus, or releases the address of a device handle.
+// Device handles should be closed before the bus is closed.
 func (i2 *I2C) Close() {
-	i2.file.Close()
+	i2.CloseErr()
+}
+
+// CloseErr is Close, returning the error from closing the device or
+// transport, such as an I2cReplay error reporting that the transactions
+// diverged. A device handle always returns nil.
+func (i2 *I2C) CloseErr() error {
+	var err error
+	if !i2.device {
+		err = busError(i2.name(), -1, "close", i2.adapter.close())
+	}
+	if i2.held {
+		release(i2.resource(i2.addr))
+		i2.held = false
+	}
+	return err
 }
 
 // Addr sets the default address.
+// The address is reserved in the registry, and may be shared with
+// other opens of the bus with the same Consumer label.
 func (i2 *I2C) Addr(addr uint16) error {
 	if (i2.funcs & 0x0002) != 0 { // 10 bit address allowed
 		if addr >= (1 << 10) {
-			return os.ErrInvalid
+			return busError(i2.name(), int(addr), "addr", os.ErrInvalid)
 		}
 	} else if addr >= (1 << 7) {
-		return os.ErrInvalid
+		return busError(i2.name(), int(addr), "addr", os.ErrInvalid)
+	}
+	if i2.held && addr == i2.addr {
+		return nil
+	}
+	if err := reserve(i2.resource(addr), i2.consumer, i2.shared); err != nil {
+		return err
+	}
+	if i2.held {
+		release(i2.resource(i2.addr))
 	}
 	i2.addr = addr
+	i2.held = true
 	return nil
 }
 
+// Device returns a handle for the device at the address on the bus.
+// Each handle has its own default address and packet error checking
+// setting, and handles may be used concurrently from separate goroutines,
+// with each transaction (such as a Message or SMBus command) completing
+// before the next one starts. Operations such as UpdateBits that use
+// more than one transaction are not atomic.
+// Timeout, Retries and TenBit apply to the whole bus.
+// The address is reserved in the registry, and is released when the
+// handle is closed, which does not close the bus.
+func (i2 *I2C) Device(addr uint16) (*I2C, error) {
+	d := &I2C{
+		bus:      i2.bus,
+		label:    i2.label,
+		adapter:  i2.adapter,
+		funcs:    i2.funcs,
+		consumer: i2.consumer,
+		shared:   i2.shared,
+		device:   true,
+	}
+	if err := d.Addr(addr); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// resource returns the name of a device address in the registry.
+func (i2 *I2C) resource(addr uint16) string {
+	return fmt.Sprintf("%s/0x%02x", i2.name(), addr)
+}
+
+// name returns the name of the bus.
+func (i2 *I2C) name() string {
+	if i2.label != "" {
+		return i2.label
+	}
+	return fmt.Sprintf("i2c-%d", i2.bus)
+}
+
 // Timeout sets the default timeout for the bus.
 func (i2 *I2C) Timeout(tout time.Duration) error {
 	// Round up to nearest 10 ms
 	v := uintptr((tout.Milliseconds() + 9) / 10)
-	return ioctl(i2.file.Fd(), i2cTimeout, v)
+	return busError(i2.name(), -1, "timeout", i2.control(i2cTimeout, v))
 }
 
 // TenBit enables 10 bit addresses.
@@ -121,12 +238,19 @@ func (i2 *I2C) TenBit(ten bool) error {
 	if ten {
 		v = 1
 	}
-	return ioctl(i2.file.Fd(), i2cTenBit, v)
+	return busError(i2.name(), -1, "ten bit", i2.control(i2cTenBit, v))
 }
 
 // Retries sets the default number of message retries.
 func (i2 *I2C) Retries(r int) error {
-	return ioctl(i2.file.Fd(), i2cRetries, uintptr(r))
+	return busError(i2.name(), -1, "retries", i2.control(i2cRetries, uintptr(r)))
+}
+
+// control performs a control request with the bus locked.
+func (i2 *I2C) control(req, arg uintptr) error {
+	i2.adapter.lock()
+	defer i2.adapter.unlock()
+	return i2.adapter.control(req, arg)
 }
 
 // Read builds a message slice that writes an 8 bit register value to the
@@ -163,28 +287,263 @@ func (i2 *I2C) WriteReg(reg, data byte) error {
 	return i2.Write(reg, []byte{data})
 }
 
+// Read16 is the same as Read, but for devices (such as EEPROMs) that
+// have a 16 bit register address, which is sent most significant byte first.
+func (i2 *I2C) Read16(reg uint16, b []byte) error {
+	m := make([]I2cMsg, 2)
+	m[0].Addr = i2.addr
+	m[0].Buf = []byte{byte(reg >> 8), byte(reg)}
+	m[1].Addr = i2.addr
+	m[1].Flags = I2cFlagRead
+	m[1].Buf = b
+	return i2.Message(m)
+}
+
+// Write16 is the same as Write, but for devices that have a 16 bit
+// register address.
+func (i2 *I2C) Write16(reg uint16, data []byte) error {
+	m := make([]I2cMsg, 1)
+	m[0].Addr = i2.addr
+	m[0].Buf = append([]byte{byte(reg >> 8), byte(reg)}, data...)
+	return i2.Message(m)
+}
+
+// ReadU16BE reads an unsigned big endian 16 bit value from two consecutive registers.
+func (i2 *I2C) ReadU16BE(reg byte) (uint16, error) {
+	b := make([]byte, 2)
+	err := i2.Read(reg, b)
+	return U16BE(b), err
+}
+
+// ReadU16LE reads an unsigned little endian 16 bit value from two consecutive registers.
+func (i2 *I2C) ReadU16LE(reg byte) (uint16, error) {
+	b := make([]byte, 2)
+	err := i2.Read(reg, b)
+	return U16LE(b), err
+}
+
+// ReadS16BE reads a signed big endian 16 bit value from two consecutive registers.
+func (i2 *I2C) ReadS16BE(reg byte) (int16, error) {
+	v, err := i2.ReadU16BE(reg)
+	return int16(v), err
+}
+
+// ReadS16LE reads a signed little endian 16 bit value from two consecutive registers.
+func (i2 *I2C) ReadS16LE(reg byte) (int16, error) {
+	v, err := i2.ReadU16LE(reg)
+	return int16(v), err
+}
+
+// ReadU24 reads an unsigned big endian 24 bit value from three consecutive registers.
+func (i2 *I2C) ReadU24(reg byte) (uint32, error) {
+	b := make([]byte, 3)
+	err := i2.Read(reg, b)
+	return U24(b), err
+}
+
+// WriteU16BE writes a big endian 16 bit value to two consecutive registers.
+func (i2 *I2C) WriteU16BE(reg byte, v uint16) error {
+	return i2.Write(reg, []byte{byte(v >> 8), byte(v)})
+}
+
+// WriteU16LE writes a little endian 16 bit value to two consecutive registers.
+func (i2 *I2C) WriteU16LE(reg byte, v uint16) error {
+	return i2.Write(reg, []byte{byte(v), byte(v >> 8)})
+}
+
+// ReadReg16 is the same as ReadReg, for a device with 16 bit register addresses.
+func (i2 *I2C) ReadReg16(reg uint16) (byte, error) {
+	b := []byte{0}
+	err := i2.Read16(reg, b)
+	return b[0], err
+}
+
+// WriteReg16 is the same as WriteReg, for a device with 16 bit register addresses.
+func (i2 *I2C) WriteReg16(reg uint16, data byte) error {
+	return i2.Write16(reg, []byte{data})
+}
+
+// Read16U16BE is the same as ReadU16BE, for a device with 16 bit register addresses.
+func (i2 *I2C) Read16U16BE(reg uint16) (uint16, error) {
+	b := make([]byte, 2)
+	err := i2.Read16(reg, b)
+	return U16BE(b), err
+}
+
+// Read16U16LE is the same as ReadU16LE, for a device with 16 bit register addresses.
+func (i2 *I2C) Read16U16LE(reg uint16) (uint16, error) {
+	b := make([]byte, 2)
+	err := i2.Read16(reg, b)
+	return U16LE(b), err
+}
+
+// Read16S16BE is the same as ReadS16BE, for a device with 16 bit register addresses.
+func (i2 *I2C) Read16S16BE(reg uint16) (int16, error) {
+	v, err := i2.Read16U16BE(reg)
+	return int16(v), err
+}
+
+// Read16S16LE is the same as ReadS16LE, for a device with 16 bit register addresses.
+func (i2 *I2C) Read16S16LE(reg uint16) (int16, error) {
+	v, err := i2.Read16U16LE(reg)
+	return int16(v), err
+}
+
+// Read16U24 is the same as ReadU24, for a device with 16 bit register addresses.
+func (i2 *I2C) Read16U24(reg uint16) (uint32, error) {
+	b := make([]byte, 3)
+	err := i2.Read16(reg, b)
+	return U24(b), err
+}
+
+// Write16U16BE is the same as WriteU16BE, for a device with 16 bit register addresses.
+func (i2 *I2C) Write16U16BE(reg uint16, v uint16) error {
+	return i2.Write16(reg, []byte{byte(v >> 8), byte(v)})
+}
+
+// Write16U16LE is the same as WriteU16LE, for a device with 16 bit register addresses.
+func (i2 *I2C) Write16U16LE(reg uint16, v uint16) error {
+	return i2.Write16(reg, []byte{byte(v), byte(v >> 8)})
+}
+
+// U16BE decodes an unsigned big endian 16 bit value, such as one
+// of a block of registers read in one transfer.
+func U16BE(b []byte) uint16 {
+	return uint16(b[0])<<8 | uint16(b[1])
+}
+
+// U16LE decodes an unsigned little endian 16 bit value.
+func U16LE(b []byte) uint16 {
+	return uint16(b[1])<<8 | uint16(b[0])
+}
+
+// S16BE decodes a signed big endian 16 bit value.
+func S16BE(b []byte) int16 {
+	return int16(U16BE(b))
+}
+
+// S16LE decodes a signed little endian 16 bit value.
+func S16LE(b []byte) int16 {
+	return int16(U16LE(b))
+}
+
+// U24 decodes an unsigned big endian 24 bit value.
+func U24(b []byte) uint32 {
+	return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+}
+
+// UpdateBits performs a read-modify-write of a register, replacing the
+// bits selected by the mask with the bits in the value.
+// The register is not written if the value is unchanged.
+func (i2 *I2C) UpdateBits(reg, mask, v byte) error {
+	old, err := i2.ReadReg(reg)
+	if err != nil {
+		return err
+	}
+	nv := old&^mask | v&mask
+	if nv == old {
+		return nil
+	}
+	return i2.WriteReg(reg, nv)
+}
+
+// UpdateBits16 is the same as UpdateBits, for a device with 16 bit
+// register addresses.
+func (i2 *I2C) UpdateBits16(reg uint16, mask, v byte) error {
+	old, err := i2.ReadReg16(reg)
+	if err != nil {
+		return err
+	}
+	nv := old&^mask | v&mask
+	if nv == old {
+		return nil
+	}
+	return i2.WriteReg16(reg, nv)
+}
+
+// MessageContext is the same as Message, but returns the context error
+// without starting the transaction if the context is done.
+// A transaction that has been started cannot be aborted, but is limited by
+// the bus timeout.
+func (i2 *I2C) MessageContext(ctx context.Context, msgs []I2cMsg) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return i2.Message(msgs)
+}
+
 // Message writes or reads the list of messages to/from the
 // peripheral device.
 func (i2 *I2C) Message(msgs []I2cMsg) error {
 	if len(msgs) == 0 || len(msgs) > I2cMaxMsgs {
-		return os.ErrInvalid
+		return busError(i2.name(), -1, "transfer", os.ErrInvalid)
 	}
+	i2.adapter.lock()
+	err := i2.adapter.transfer(msgs)
+	i2.adapter.unlock()
+	return busError(i2.name(), int(msgs[0].Addr), "transfer", err)
+}
+
+// transfer sends the messages using the I2C_RDWR ioctl.
+func (d *i2cDev) lock() {
+	d.mu.Lock()
+}
+
+func (d *i2cDev) unlock() {
+	d.mu.Unlock()
+}
+
+func (d *i2cDev) transfer(msgs []I2cMsg) error {
 	m := make([]i2c_msg, len(msgs))
 	mi := &i2c_rdwr{uintptr(unsafe.Pointer(&m[0])), uint32(len(m))}
 	for i := range msgs {
 		m[i].addr = msgs[i].Addr
 		m[i].len = uint16(len(msgs[i].Buf))
-		m[i].buf = uintptr(unsafe.Pointer(&msgs[i].Buf[0]))
+		if len(msgs[i].Buf) != 0 {
+			m[i].buf = uintptr(unsafe.Pointer(&msgs[i].Buf[0]))
+		}
 		if msgs[i].Flags&I2cFlagRead != 0 {
 			m[i].flags |= 0x0001
 		}
 		if msgs[i].Flags&I2cFlagTenBit != 0 {
 			m[i].flags |= 0x0010
 		}
+		if msgs[i].Flags&I2cFlagRecvLen != 0 {
+			m[i].flags |= 0x0400
+		}
 	}
-	err := ioctl(i2.file.Fd(), i2cRdWr, uintptr(unsafe.Pointer(mi)))
-	if err != nil {
-		return err
+	return ioctl(d.file.Fd(), i2cRdWr, uintptr(unsafe.Pointer(mi)))
+}
+
+// smbus performs a SMBus command using the I2C_SMBUS ioctl.
+// The device address and packet error checking are selected first
+// if they have changed.
+func (d *i2cDev) smbus(addr uint16, pec bool, args *i2c_smbus_ioctl_data) error {
+	if d.slave != int(addr) {
+		if err := ioctl(d.file.Fd(), i2cSlave, uintptr(addr)); err != nil {
+			return err
+		}
+		d.slave = int(addr)
 	}
-	return nil
+	if d.pec != pec {
+		var v uintptr
+		if pec {
+			v = 1
+		}
+		if err := ioctl(d.file.Fd(), i2cPec, v); err != nil {
+			return err
+		}
+		d.pec = pec
+	}
+	return ioctl(d.file.Fd(), i2cSmbus, uintptr(unsafe.Pointer(args)))
+}
+
+// control performs an ioctl on the device.
+func (d *i2cDev) control(req, arg uintptr) error {
+	return ioctl(d.file.Fd(), req, arg)
+}
+
+// close closes the device.
+func (d *i2cDev) close() error {
+	return d.file.Close()
 }
@@ -0,0 +1,181 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package io
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestI2cDecode(t *testing.T) {
+	b := []byte{0xFE, 0xDC, 0xBA}
+	if v := U16BE(b); v != 0xFEDC {
+		t.Errorf("U16BE: got 0x%x", v)
+	}
+	if v := U16LE(b); v != 0xDCFE {
+		t.Errorf("U16LE: got 0x%x", v)
+	}
+	if v := S16BE(b); v != -292 {
+		t.Errorf("S16BE: got %d", v)
+	}
+	if v := S16LE(b); v != -8962 {
+		t.Errorf("S16LE: got %d", v)
+	}
+	if v := U24(b); v != 0xFEDCBA {
+		t.Errorf("U24: got 0x%x", v)
+	}
+}
+
+func TestI2cReg16(t *testing.T) {
+	i2, f := newFakeI2c(i2cFuncI2c)
+	f.reply = []byte{0x12, 0x34, 0x56}
+	if v, err := i2.Read16U16BE(0x0102); err != nil || v != 0x1234 {
+		t.Errorf("Read16U16BE: got 0x%x, %v", v, err)
+	}
+	if v, err := i2.Read16S16LE(0x0102); err != nil || v != 0x3412 {
+		t.Errorf("Read16S16LE: got 0x%x, %v", v, err)
+	}
+	if v, err := i2.Read16U24(0x0102); err != nil || v != 0x123456 {
+		t.Errorf("Read16U24: got 0x%x, %v", v, err)
+	}
+	if err := i2.Write16U16LE(0x0304, 0xBEEF); err != nil {
+		t.Fatal(err)
+	}
+	// Only the bits selected are changed.
+	f.reply = []byte{0xF0}
+	if err := i2.UpdateBits16(0x0506, 0x0F, 0x05); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]I2cMsg{
+		{{Addr: 0x48, Buf: []byte{0x01, 0x02}}, {Addr: 0x48, Flags: I2cFlagRead, Buf: []byte{0, 0}}},
+		{{Addr: 0x48, Buf: []byte{0x01, 0x02}}, {Addr: 0x48, Flags: I2cFlagRead, Buf: []byte{0, 0}}},
+		{{Addr: 0x48, Buf: []byte{0x01, 0x02}}, {Addr: 0x48, Flags: I2cFlagRead, Buf: []byte{0, 0, 0}}},
+		{{Addr: 0x48, Buf: []byte{0x03, 0x04, 0xEF, 0xBE}}},
+		{{Addr: 0x48, Buf: []byte{0x05, 0x06}}, {Addr: 0x48, Flags: I2cFlagRead, Buf: []byte{0}}},
+		{{Addr: 0x48, Buf: []byte{0x05, 0x06, 0xF5}}},
+	}
+	checkXfers(t, f.xfers, want)
+}
+
+func TestI2cDevices(t *testing.T) {
+	i2, f := newFakeI2c(i2cFuncI2c | smbusAll)
+	f.yield = true
+	d1, err := i2.Device(0x20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d2, err := i2.Device(0x21)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Packet error checking is set per handle.
+	if err := d1.PEC(true); err != nil {
+		t.Fatal(err)
+	}
+	// Each handle writes its own address as the data, so that a
+	// transaction sent to the wrong address can be seen.
+	const n = 100
+	var wg sync.WaitGroup
+	for _, d := range []*I2C{d1, d2} {
+		wg.Add(1)
+		go func(d *I2C) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				if err := d.Write(byte(i), []byte{byte(d.addr)}); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := d.WriteByteData(byte(i), byte(d.addr)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(d)
+	}
+	wg.Wait()
+	if len(f.xfers) != 2*n || len(f.cmds) != 2*n {
+		t.Fatalf("got %d transfers and %d commands, want %d of each", len(f.xfers), len(f.cmds), 2*n)
+	}
+	for _, x := range f.xfers {
+		if len(x) != 1 || len(x[0].Buf) != 2 || x[0].Addr != uint16(x[0].Buf[1]) {
+			t.Errorf("transfer %v: wrong address", x)
+		}
+	}
+	for _, c := range f.cmds {
+		if c.addr != uint16(c.data[0]) || c.pec != (c.addr == 0x20) {
+			t.Errorf("command to 0x%x: data 0x%x, pec %v", c.addr, c.data[0], c.pec)
+		}
+	}
+
+	// The addresses are reserved until the handle is closed or moved.
+	if _, err := i2.Device(0x20); !errors.Is(err, ErrBusy) {
+		t.Errorf("Device(0x20) while held: got %v, want ErrBusy", err)
+	}
+	if err := i2.Addr(0x21); !errors.Is(err, ErrBusy) {
+		t.Errorf("Addr(0x21) while held: got %v, want ErrBusy", err)
+	}
+	want := []Allocation{{Resource: "i2c-1/0x20", Refs: 1}, {Resource: "i2c-1/0x21", Refs: 1}}
+	if al := Allocations(); !reflect.DeepEqual(al, want) {
+		t.Errorf("Allocations: got %v, want %v", al, want)
+	}
+	if err := d1.Addr(0x22); err != nil {
+		t.Fatal(err)
+	}
+	d3, err := i2.Device(0x20)
+	if err != nil {
+		t.Fatalf("Device(0x20) after moving: %v", err)
+	}
+	d1.Close()
+	d2.Close()
+	if err := i2.Addr(0x21); err != nil {
+		t.Errorf("Addr(0x21) after close: %v", err)
+	}
+	want = []Allocation{{Resource: "i2c-1/0x20", Refs: 1}, {Resource: "i2c-1/0x21", Refs: 1}}
+	if al := Allocations(); !reflect.DeepEqual(al, want) {
+		t.Errorf("Allocations: got %v, want %v", al, want)
+	}
+	// Closing the handles does not close the bus.
+	if err := i2.WriteByteData(0x30, 0x21); err != nil {
+		t.Errorf("bus after closing handles: %v", err)
+	}
+	d3.Close()
+	i2.Close()
+	if al := Allocations(); len(al) != 0 {
+		t.Errorf("Allocations after close: got %v, want none", al)
+	}
+
+	// With a Consumer label the address may be shared, and is released
+	// when the last handle is closed.
+	i2.consumer, i2.shared = "sensor", true
+	s1, err := i2.Device(0x40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := i2.Device(0x40)
+	if err != nil {
+		t.Fatalf("shared Device(0x40): %v", err)
+	}
+	s1.Close()
+	want = []Allocation{{Resource: "i2c-1/0x40", Consumer: "sensor", Refs: 1}}
+	if al := Allocations(); !reflect.DeepEqual(al, want) {
+		t.Errorf("Allocations: got %v, want %v", al, want)
+	}
+	s2.Close()
+	if al := Allocations(); len(al) != 0 {
+		t.Errorf("Allocations after closing shared handles: got %v, want none", al)
+	}
+}
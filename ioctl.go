@@ -28,7 +28,11 @@ func ioctl32(fd, req uintptr, i *uint32) error {
 	return ioctl(fd, req, uintptr(unsafe.Pointer(i)))
 }
 
-func ioctl(fd, req, arg uintptr) error {
+// ioctl performs an ioctl on a device. It is a variable so that the
+// kernel drivers can be replaced by a fake in tests.
+var ioctl = sysIoctl
+
+func sysIoctl(fd, req, arg uintptr) error {
 	_, _, ep := unix.Syscall(unix.SYS_IOCTL, fd, req, arg)
 	if ep != 0 {
 		return ep
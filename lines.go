@@ -0,0 +1,157 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Groups of GPIO pins that are set and read together.
+
+package io
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Lines represents a group of GPIO pins that are set or read together.
+// Bit n of the values corresponds to pin n of the group.
+// When requested from a GPIO character device, the values are set and
+// read atomically. When opened via sysfs, the pins are set and read
+// individually in order.
+type Lines struct {
+	fd        int     // Line request file descriptor (character device)
+	chip      int     // Chip number (character device)
+	offsets   []int   // Line offsets (character device)
+	pins      []*Gpio // Pins (sysfs)
+	count     int
+	direction int
+}
+
+// Lines requests a group of lines from the chip with the direction selected.
+// The options (such as Bias, Drive and ActiveLow) apply to all the lines
+// of the group.
+func (c *Chip) Lines(dir int, offsets []int, opts ...Option) (*Lines, error) {
+	if dir != IN && dir != OUT {
+		return nil, pinError(fmt.Sprintf("gpiochip%d/%v", c.number, offsets), "request", os.ErrInvalid)
+	}
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := c.requestLines(dir, cfg.lineFlags(), cfg.consumer, offsets)
+	if err != nil {
+		return nil, err
+	}
+	return &Lines{fd: fd, chip: c.number, offsets: append([]int(nil), offsets...), count: len(offsets), direction: dir}, nil
+}
+
+// GpioLines opens a group of sysfs GPIO pins with the direction selected.
+// The options apply to all the pins of the group, with the same
+// restrictions as Pin.
+func GpioLines(dir int, gpios []int, opts ...Option) (*Lines, error) {
+	if (dir != IN && dir != OUT) || len(gpios) == 0 || len(gpios) > gpioV2LinesMax {
+		return nil, pinError(fmt.Sprintf("gpio%v", gpios), "request", os.ErrInvalid)
+	}
+	l := &Lines{fd: -1, count: len(gpios), direction: dir}
+	for _, n := range gpios {
+		g, err := Pin(n, opts...)
+		if err == nil {
+			err = g.Direction(dir)
+			if err != nil {
+				g.Close()
+			}
+		}
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		l.pins = append(l.pins, g)
+	}
+	return l, nil
+}
+
+// Len returns the number of pins in the group.
+func (l *Lines) Len() int {
+	return l.count
+}
+
+// SetValues sets the outputs of the group (only valid for OUTPUT pins).
+func (l *Lines) SetValues(v uint64) error {
+	if l.direction != OUT {
+		return pinError(l.resource(), "set", ErrNotOutput)
+	}
+	if l.fd < 0 {
+		for i, g := range l.pins {
+			err := g.Set(int(v>>uint(i)) & 1)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	vals := gpio_v2_line_values{bits: v & l.mask(), mask: l.mask()}
+	return pinError(l.resource(), "set", ioctl(uintptr(l.fd), gpioV2SetValues, uintptr(unsafe.Pointer(&vals))))
+}
+
+// GetValues returns the current values of the group.
+func (l *Lines) GetValues() (uint64, error) {
+	if l.fd < 0 {
+		var v uint64
+		for i, g := range l.pins {
+			b, err := g.read(g.buf)
+			if err != nil {
+				return 0, pinError(g.resource(), "get", err)
+			}
+			v |= uint64(b) << uint(i)
+		}
+		return v, nil
+	}
+	vals := gpio_v2_line_values{mask: l.mask()}
+	err := ioctl(uintptr(l.fd), gpioV2GetValues, uintptr(unsafe.Pointer(&vals)))
+	if err != nil {
+		return 0, pinError(l.resource(), "get", err)
+	}
+	return vals.bits, nil
+}
+
+// Close releases the group of pins.
+func (l *Lines) Close() {
+	if l.fd >= 0 {
+		unix.Close(l.fd)
+		releaseLines(l.chip, l.offsets)
+	}
+	for _, g := range l.pins {
+		g.Close()
+	}
+}
+
+// resource returns the name of the group used in errors.
+func (l *Lines) resource() string {
+	if l.fd >= 0 {
+		return fmt.Sprintf("gpiochip%d/%v", l.chip, l.offsets)
+	}
+	var gpios []int
+	for _, g := range l.pins {
+		gpios = append(gpios, g.number)
+	}
+	return fmt.Sprintf("gpio%v", gpios)
+}
+
+// mask returns a mask covering all the pins in the group.
+func (l *Lines) mask() uint64 {
+	if l.count == gpioV2LinesMax {
+		return ^uint64(0)
+	}
+	return (uint64(1) << uint(l.count)) - 1
+}
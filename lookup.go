@@ -0,0 +1,187 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Lookup of GPIO lines by name.
+
+package io
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+var gpioV2GetLineInfo = iocRW(gpioCode, 0x05, unsafe.Sizeof(gpio_v2_line_info{}))
+
+type gpio_v2_line_info struct {
+	name      [gpioMaxNameSize]byte
+	consumer  [gpioMaxNameSize]byte
+	offset    uint32
+	num_attrs uint32
+	flags     uint64
+	attrs     [gpioV2NumAttrMax]gpio_v2_line_attribute
+	_         [4]uint32
+}
+
+// LineName returns the name of a line on the chip.
+func (c *Chip) LineName(offset int) (string, error) {
+	if offset < 0 || offset >= c.lines {
+		return "", pinError(lineResource(c.number, offset), "line info", os.ErrInvalid)
+	}
+	info, err := c.lineInfo(offset)
+	if err != nil {
+		return "", pinError(lineResource(c.number, offset), "line info", err)
+	}
+	return cString(info.name[:]), nil
+}
+
+// lineInfo returns the kernel information about a line.
+func (c *Chip) lineInfo(offset int) (*gpio_v2_line_info, error) {
+	info := new(gpio_v2_line_info)
+	info.offset = uint32(offset)
+	err := ioctl(c.file.Fd(), gpioV2GetLineInfo, uintptr(unsafe.Pointer(info)))
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// FindLine returns the offset of the line with the name selected.
+func (c *Chip) FindLine(name string) (int, error) {
+	for i := 0; i < c.lines; i++ {
+		n, err := c.LineName(i)
+		if err != nil {
+			return 0, err
+		}
+		if n == name {
+			return i, nil
+		}
+	}
+	return 0, os.ErrNotExist
+}
+
+// Chips returns the numbers of the GPIO character devices present.
+func Chips() ([]int, error) {
+	m, err := filepath.Glob(rootPath("/dev/gpiochip*"))
+	if err != nil {
+		return nil, err
+	}
+	var chips []int
+	for _, f := range m {
+		n, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(f), "gpiochip"))
+		if err == nil {
+			chips = append(chips, n)
+		}
+	}
+	sort.Ints(chips)
+	return chips, nil
+}
+
+// FindLine searches all the GPIO chips for a line with the name selected
+// (e.g "GPIO17"), and returns the chip and line offset.
+// If the line is not found and a chip could not be searched (such as
+// when permission to open it is denied), the first such error is returned.
+func FindLine(name string) (chip, offset int, err error) {
+	chips, err := Chips()
+	if err != nil {
+		return 0, 0, err
+	}
+	var firstErr error
+	for _, n := range chips {
+		c, err := OpenChip(n)
+		if err == nil {
+			var offset int
+			offset, err = c.FindLine(name)
+			c.Close()
+			if err == nil {
+				return n, offset, nil
+			}
+		}
+		if firstErr == nil && !errors.Is(err, os.ErrNotExist) {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return 0, 0, fmt.Errorf("%s: %w", name, firstErr)
+	}
+	return 0, 0, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+}
+
+// PinByName opens the line with the name selected as an input.
+func PinByName(name string, opts ...Option) (*Line, error) {
+	chip, offset, err := FindLine(name)
+	if err != nil {
+		return nil, err
+	}
+	return ChipPin(chip, offset, opts...)
+}
+
+// OutputPinByName opens the line with the name selected as an output.
+func OutputPinByName(name string, opts ...Option) (*Line, error) {
+	chip, offset, err := FindLine(name)
+	if err != nil {
+		return nil, err
+	}
+	return ChipOutputPin(chip, offset, opts...)
+}
+
+// GpioNumber returns the sysfs GPIO number of the line with the name
+// selected, for use with Pin and OutputPin. The number is calculated
+// from the base of the sysfs gpiochip that has the same label and
+// number of lines as the character device.
+func GpioNumber(name string) (int, error) {
+	chip, offset, err := FindLine(name)
+	if err != nil {
+		return 0, err
+	}
+	c, err := OpenChip(chip)
+	if err != nil {
+		return 0, err
+	}
+	c.Close()
+	m, err := filepath.Glob(rootPath(gpioBaseDir + "gpiochip*"))
+	if err != nil {
+		return 0, err
+	}
+	for _, d := range m {
+		label, err := os.ReadFile(filepath.Join(d, "label"))
+		if err != nil || strings.TrimSpace(string(label)) != c.label {
+			continue
+		}
+		ngpio, err := readInt(filepath.Join(d, "ngpio"))
+		if err != nil || ngpio != c.lines {
+			continue
+		}
+		base, err := readInt(filepath.Join(d, "base"))
+		if err != nil {
+			return 0, err
+		}
+		return base + offset, nil
+	}
+	return 0, fmt.Errorf("%s: no sysfs gpiochip for %s: %w", name, c.name, os.ErrNotExist)
+}
+
+// readInt reads an integer from a file.
+func readInt(f string) (int, error) {
+	b, err := os.ReadFile(f)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
@@ -0,0 +1,45 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package io
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestFindLine(t *testing.T) {
+	newFakeChip(t, 8)
+	if chip, offset, err := FindLine("L5"); err != nil || chip != 0 || offset != 5 {
+		t.Errorf("FindLine(L5): got %d, %d, %v", chip, offset, err)
+	}
+	if _, _, err := FindLine("GPIO99"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("FindLine(GPIO99): got %v, want ErrNotExist", err)
+	}
+	// A chip that cannot be opened is reported rather than the line
+	// being reported as not existing.
+	if err := os.Mkdir(filepath.Join(Root, "dev", "gpiochip1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err := FindLine("GPIO99")
+	if !errors.Is(err, syscall.EISDIR) || errors.Is(err, os.ErrNotExist) {
+		t.Errorf("FindLine with an unopenable chip: got %v, want EISDIR", err)
+	}
+	if chip, offset, err := FindLine("L2"); err != nil || chip != 0 || offset != 2 {
+		t.Errorf("FindLine(L2): got %d, %d, %v", chip, offset, err)
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// I2C multiplexers such as the TCA9548A and PCA9548.
+
+package io
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// I2cMux represents an I2C multiplexer, where a control register selects
+// which downstream channels are connected to the bus. Each channel is
+// accessed through its own I2C handle, which selects the channel before
+// each transaction. The parent bus is locked while the channel is selected
+// and the transaction is performed, so that no other user of the bus can
+// interleave, but devices behind the mux should not be accessed through
+// the parent bus.
+type I2cMux struct {
+	i2       *I2C
+	addr     uint16
+	channels int
+	mu       sync.Mutex
+	current  int  // Channel currently selected, or -1 if unknown
+	closed   bool // Mux has been closed
+}
+
+// muxChannel is the adapter for one channel of a multiplexer.
+type muxChannel struct {
+	mux *I2cMux
+	ch  int
+}
+
+// NewI2cMux creates a multiplexer at the address on the bus, with the
+// number of channels selected (8 for the TCA9548A).
+// The mux address is reserved in the registry.
+func NewI2cMux(i2 *I2C, addr uint16, channels int) (*I2cMux, error) {
+	if channels < 1 || channels > 8 || addr >= (1<<7) {
+		return nil, busError(i2.name(), int(addr), "mux", os.ErrInvalid)
+	}
+	if err := reserve(i2.resource(addr), i2.consumer, false); err != nil {
+		return nil, err
+	}
+	return &I2cMux{i2: i2, addr: addr, channels: channels, current: -1}, nil
+}
+
+// Channel returns an I2C handle for the channel. Transactions on the
+// handle select the channel first if it is not already selected.
+// The handle should be closed when no longer required, which does
+// not close the parent bus. Once the mux is closed, transactions on
+// the handle return os.ErrClosed.
+func (m *I2cMux) Channel(ch int) (*I2C, error) {
+	if ch < 0 || ch >= m.channels {
+		return nil, busError(m.i2.name(), int(m.addr), "mux channel", os.ErrInvalid)
+	}
+	m.mu.Lock()
+	closed := m.closed
+	m.mu.Unlock()
+	if closed {
+		return nil, busError(m.i2.name(), int(m.addr), "mux channel", os.ErrClosed)
+	}
+	return &I2C{
+		bus:      m.i2.bus,
+		label:    fmt.Sprintf("%s/mux-0x%02x.%d", m.i2.name(), m.addr, ch),
+		adapter:  &muxChannel{mux: m, ch: ch},
+		funcs:    m.i2.funcs,
+		consumer: m.i2.consumer,
+		shared:   m.i2.shared,
+	}, nil
+}
+
+// Close deselects all the channels and releases the mux address.
+// The parent bus is not closed.
+func (m *I2cMux) Close() error {
+	m.i2.adapter.lock()
+	defer m.i2.adapter.unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	err := m.selectChannel(-1)
+	release(m.i2.resource(m.addr))
+	return busError(m.i2.name(), int(m.addr), "mux", err)
+}
+
+// selectChannel writes the control register to select a channel
+// (or no channel if ch is -1). The parent bus must be locked,
+// and the mutex held.
+func (m *I2cMux) selectChannel(ch int) error {
+	if ch == m.current && ch >= 0 {
+		return nil
+	}
+	var ctl byte
+	if ch >= 0 {
+		ctl = 1 << uint(ch)
+	}
+	var err error
+	if m.i2.funcs&i2cFuncI2c != 0 {
+		err = m.i2.adapter.transfer([]I2cMsg{{Addr: m.addr, Buf: []byte{ctl}}})
+	} else {
+		err = m.i2.adapter.smbus(m.addr, false, &i2c_smbus_ioctl_data{read_write: smbusWrite, command: ctl, size: smbusByte})
+	}
+	if err != nil {
+		// The state of the mux is unknown.
+		m.current = -1
+		return err
+	}
+	m.current = ch
+	return nil
+}
+
+// lock locks the parent bus, so that the channel select and the
+// transfer that follows it are not interleaved with other users.
+func (c *muxChannel) lock() {
+	c.mux.i2.adapter.lock()
+	c.mux.mu.Lock()
+}
+
+func (c *muxChannel) unlock() {
+	c.mux.mu.Unlock()
+	c.mux.i2.adapter.unlock()
+}
+
+func (c *muxChannel) transfer(msgs []I2cMsg) error {
+	if c.mux.closed {
+		return os.ErrClosed
+	}
+	if err := c.mux.selectChannel(c.ch); err != nil {
+		return err
+	}
+	return c.mux.i2.adapter.transfer(msgs)
+}
+
+func (c *muxChannel) smbus(addr uint16, pec bool, args *i2c_smbus_ioctl_data) error {
+	if c.mux.closed {
+		return os.ErrClosed
+	}
+	if err := c.mux.selectChannel(c.ch); err != nil {
+		return err
+	}
+	return c.mux.i2.adapter.smbus(addr, pec, args)
+}
+
+// control applies to the parent bus, so timeouts and retries
+// are shared by all the channels.
+func (c *muxChannel) control(req, arg uintptr) error {
+	return c.mux.i2.adapter.control(req, arg)
+}
+
+func (c *muxChannel) close() error {
+	return nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package io
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestI2cMux(t *testing.T) {
+	i2, f := newFakeI2c(i2cFuncI2c)
+	m, err := NewI2cMux(i2, 0x70, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch1, err := m.Channel(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch2, err := m.Channel(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ch1.Message([]I2cMsg{{Addr: 0x20, Buf: []byte{1}}}); err != nil {
+		t.Fatal(err)
+	}
+	// The channel is only selected when it changes.
+	if err := ch1.Message([]I2cMsg{{Addr: 0x20, Buf: []byte{2}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch2.Message([]I2cMsg{{Addr: 0x21, Buf: []byte{3}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]I2cMsg{
+		{{Addr: 0x70, Buf: []byte{0x02}}},
+		{{Addr: 0x20, Buf: []byte{1}}},
+		{{Addr: 0x20, Buf: []byte{2}}},
+		{{Addr: 0x70, Buf: []byte{0x04}}},
+		{{Addr: 0x21, Buf: []byte{3}}},
+		{{Addr: 0x70, Buf: []byte{0x00}}},
+	}
+	checkXfers(t, f.xfers, want)
+	if len(Allocations()) != 0 {
+		t.Errorf("allocations after close: %v", Allocations())
+	}
+
+	// The channels cannot be used once the mux is closed.
+	f.xfers = nil
+	if err := ch1.Message([]I2cMsg{{Addr: 0x20, Buf: []byte{1}}}); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Message after Close: got %v, want ErrClosed", err)
+	}
+	if _, err := ch2.ReadByteData(0x10); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("ReadByteData after Close: got %v, want ErrClosed", err)
+	}
+	if _, err := m.Channel(3); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Channel after Close: got %v, want ErrClosed", err)
+	}
+	if len(f.xfers) != 0 {
+		t.Errorf("%d transfers after Close", len(f.xfers))
+	}
+	if err := m.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
+
+func TestI2cMuxConcurrent(t *testing.T) {
+	i2, f := newFakeI2c(i2cFuncI2c)
+	m, err := NewI2cMux(i2, 0x70, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	f.yield = true
+	var wg sync.WaitGroup
+	run := func(bus *I2C, addr uint16) {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			if err := bus.Message([]I2cMsg{{Addr: addr, Buf: []byte{byte(i)}}}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}
+	for ch, addr := range map[int]uint16{1: 0x20, 2: 0x21} {
+		c, err := m.Channel(ch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go run(c, addr)
+	}
+	// Another user of the parent bus.
+	wg.Add(1)
+	go run(i2, 0x50)
+	wg.Wait()
+	// Each channel select is followed by a transfer on the channel, and
+	// the transfers on a channel are only made when it is selected.
+	chans := map[byte]uint16{0x02: 0x20, 0x04: 0x21}
+	selected := uint16(0)
+	count := map[uint16]int{}
+	for i, x := range f.xfers {
+		addr := x[0].Addr
+		count[addr]++
+		switch addr {
+		case 0x70:
+			selected = chans[x[0].Buf[0]]
+			if i+1 >= len(f.xfers) || f.xfers[i+1][0].Addr != selected {
+				t.Fatalf("transfer %d: select of 0x%02x not followed by a transfer on the channel", i, x[0].Buf[0])
+			}
+		case 0x20, 0x21:
+			if addr != selected {
+				t.Fatalf("transfer %d: to 0x%02x with 0x%02x selected", i, addr, selected)
+			}
+		}
+	}
+	if count[0x20] != 100 || count[0x21] != 100 || count[0x50] != 100 {
+		t.Errorf("transfer counts: got %v", count)
+	}
+}
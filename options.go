@@ -0,0 +1,133 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Options used when opening pins.
+
+package io
+
+import (
+	"os"
+	"time"
+)
+
+// Bias
+const (
+	BiasAsIs     = iota // Default, bias is left unchanged
+	BiasDisabled = iota
+	BiasPullUp   = iota
+	BiasPullDown = iota
+)
+
+// Drive
+const (
+	DrivePushPull   = iota // Default
+	DriveOpenDrain  = iota
+	DriveOpenSource = iota
+)
+
+// Option is an optional setting that is applied when opening a pin.
+type Option func(*config) error
+
+// config holds the settings selected by the options.
+type config struct {
+	bias        int
+	drive       int
+	activeLow   bool
+	consumer    string
+	consumerSet bool // Consumer was set by an option
+
+	verify        int           // Verification strategy
+	verifyTimeout time.Duration // Verification timeout
+}
+
+// Bias selects the bias (pull up or pull down) of a pin.
+func Bias(b int) Option {
+	return func(c *config) error {
+		if b < BiasAsIs || b > BiasPullDown {
+			return os.ErrInvalid
+		}
+		c.bias = b
+		return nil
+	}
+}
+
+// Drive selects the drive mode of an output pin.
+func Drive(d int) Option {
+	return func(c *config) error {
+		if d < DrivePushPull || d > DriveOpenSource {
+			return os.ErrInvalid
+		}
+		c.drive = d
+		return nil
+	}
+}
+
+// ActiveLow inverts the pin, so that a value of 1 drives the line low (active).
+func ActiveLow() Option {
+	return func(c *config) error {
+		c.activeLow = true
+		return nil
+	}
+}
+
+// Consumer sets the label identifying the user of a pin or device.
+// The label is recorded in the allocation registry, and is passed to
+// the kernel when requesting lines from a GPIO character device.
+// Opens of the same resource with the same label may be shared where
+// this is safe. Opens without a label are never shared.
+func Consumer(label string) Option {
+	return func(c *config) error {
+		if label == "" {
+			return os.ErrInvalid
+		}
+		c.consumer = label
+		c.consumerSet = true
+		return nil
+	}
+}
+
+// VerifyStrategy selects how exported sysfs files are verified as
+// writable before they are used (VerifyNone, VerifyPoll or VerifyInotify).
+func VerifyStrategy(s int) Option {
+	return func(c *config) error {
+		if s < VerifyDefault || s > VerifyInotify {
+			return os.ErrInvalid
+		}
+		c.verify = s
+		return nil
+	}
+}
+
+// VerifyTimeout sets how long to wait for exported sysfs files to
+// become writable.
+func VerifyTimeout(d time.Duration) Option {
+	return func(c *config) error {
+		if d <= 0 {
+			return os.ErrInvalid
+		}
+		c.verifyTimeout = d
+		return nil
+	}
+}
+
+// newConfig applies the options to a new config.
+func newConfig(opts []Option) (*config, error) {
+	c := &config{consumer: gpioConsumer, verifyTimeout: verifyTimeout}
+	for _, o := range opts {
+		if err := o(c); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,188 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package io
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// poll waits for events on file descriptors. It is a variable so that
+// the edges of an emulated sysfs tree can be signalled in tests, since
+// regular files cannot poll for POLLPRI.
+var poll = unix.Poll
+
+// pollers tracks the pollers waiting on the file descriptor of a pin,
+// so that they can be woken and finished before the descriptor is closed.
+// Closing the descriptor does not wake a blocked poll, and a descriptor
+// that is reused would otherwise be polled in its place.
+// A single eventfd, created on first use, wakes all the pollers.
+type pollers struct {
+	mu      sync.Mutex
+	closed  bool
+	efd     int
+	haveEfd bool
+	wg      sync.WaitGroup
+}
+
+// add registers a new poller, and returns the eventfd that is signalled
+// when the pin is closed.
+func (ps *pollers) add() (int, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.closed {
+		return -1, os.ErrClosed
+	}
+	if !ps.haveEfd {
+		efd, err := unix.Eventfd(0, unix.EFD_CLOEXEC)
+		if err != nil {
+			return -1, err
+		}
+		ps.efd = efd
+		ps.haveEfd = true
+	}
+	ps.wg.Add(1)
+	return ps.efd, nil
+}
+
+// close wakes the pollers, and waits for them to finish.
+func (ps *pollers) close() {
+	ps.mu.Lock()
+	if ps.closed {
+		ps.mu.Unlock()
+		return
+	}
+	ps.closed = true
+	if ps.haveEfd {
+		unix.Write(ps.efd, []byte{1, 0, 0, 0, 0, 0, 0, 0})
+	}
+	ps.mu.Unlock()
+	ps.wg.Wait()
+	if ps.haveEfd {
+		unix.Close(ps.efd)
+	}
+}
+
+// ctxPoller polls a file descriptor, and returns early if the pin is
+// closed or the context is cancelled. If the context can be cancelled,
+// an eventfd is used to wake the poll when the context is done.
+type ctxPoller struct {
+	ctx  context.Context
+	ps   *pollers
+	pfd  []unix.PollFd
+	efd  int
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newCtxPoller creates a poller for the file descriptor and events.
+func newCtxPoller(ctx context.Context, ps *pollers, fd int, events int16) (*ctxPoller, error) {
+	closeFd, err := ps.add()
+	if err != nil {
+		return nil, err
+	}
+	p := &ctxPoller{ctx: ctx, ps: ps, efd: -1}
+	p.pfd = []unix.PollFd{{Fd: int32(fd), Events: events}, {Fd: int32(closeFd), Events: unix.POLLIN}}
+	if ctx.Done() == nil {
+		// Context can never be cancelled.
+		return p, nil
+	}
+	p.efd, err = unix.Eventfd(0, unix.EFD_CLOEXEC)
+	if err != nil {
+		ps.wg.Done()
+		return nil, err
+	}
+	p.pfd = append(p.pfd, unix.PollFd{Fd: int32(p.efd), Events: unix.POLLIN})
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	go func() {
+		defer close(p.done)
+		select {
+		case <-ctx.Done():
+			unix.Write(p.efd, []byte{1, 0, 0, 0, 0, 0, 0, 0})
+		case <-p.stop:
+		}
+	}()
+	return p, nil
+}
+
+// wait waits for the file descriptor to be ready, and returns the events
+// that are pending. A timeout of 0 is interpreted as no timeout.
+// If the timeout expires, os.ErrDeadlineExceeded is returned, if the
+// context is done, the context error is returned, and if the pin is
+// closed, os.ErrClosed is returned.
+func (p *ctxPoller) wait(tout time.Duration) (int16, error) {
+	if err := p.ctx.Err(); err != nil {
+		return 0, err
+	}
+	tout_ms := -1
+	if tout != 0 {
+		tout_ms = msRoundUp(tout)
+	}
+	for {
+		for i := range p.pfd {
+			p.pfd[i].Revents = 0
+		}
+		n, err := poll(p.pfd, tout_ms)
+		switch err {
+		case nil:
+			// Successful call
+		case unix.EAGAIN:
+			continue
+		case unix.EINTR:
+			continue
+		default:
+			return 0, err
+		}
+		if p.pfd[1].Revents != 0 {
+			return 0, os.ErrClosed
+		}
+		if len(p.pfd) > 2 && p.pfd[2].Revents != 0 {
+			return 0, p.ctx.Err()
+		}
+		if n == 0 {
+			return 0, os.ErrDeadlineExceeded
+		}
+		return p.pfd[0].Revents, nil
+	}
+}
+
+// close releases the resources held by the poller.
+func (p *ctxPoller) close() {
+	if p.efd >= 0 {
+		close(p.stop)
+		<-p.done
+		unix.Close(p.efd)
+	}
+	p.ps.wg.Done()
+}
+
+// msRoundUp converts a timeout to milliseconds, rounding up so that
+// short timeouts do not become a zero timeout.
+func msRoundUp(tout time.Duration) int {
+	return int((tout + time.Millisecond - 1) / time.Millisecond)
+}
+
+// monotonic returns the current value of the monotonic clock, which
+// is the same clock used by the kernel to timestamp GPIO line events.
+func monotonic() time.Duration {
+	var ts unix.Timespec
+	unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts)
+	return time.Duration(ts.Nano())
+}
@@ -0,0 +1,199 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Recording and replay of I2C transactions.
+// Transactions are recorded as a file of JSON objects, one per line.
+
+package io
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	stdio "io"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// I2cRecord is the record of one transaction.
+type I2cRecord struct {
+	Msgs     []I2cRecordMsg `json:"msgs"`
+	Duration time.Duration  `json:"duration"`
+	Err      string         `json:"err,omitempty"`
+	Errno    int            `json:"errno,omitempty"` // Error number if the error was a system error
+}
+
+// I2cRecordMsg is the record of one message of a transaction.
+// For reads, Data is the data read.
+type I2cRecordMsg struct {
+	Addr  uint16 `json:"addr"`
+	Flags int    `json:"flags"`
+	Len   int    `json:"len"`
+	Data  string `json:"data"` // Hex encoded data
+}
+
+// I2cRecorder is a transport that writes a record of each transaction
+// to a writer, and passes the transaction to another transport.
+type I2cRecorder struct {
+	t  I2cTransport
+	mu sync.Mutex
+	w  stdio.Writer
+	e  *json.Encoder
+}
+
+// NewI2cRecorder creates a recorder that writes the transactions sent
+// on the transport. If the writer is an io.Closer, it is closed when
+// the recorder is closed.
+func NewI2cRecorder(t I2cTransport, w stdio.Writer) *I2cRecorder {
+	return &I2cRecorder{t: t, w: w, e: json.NewEncoder(w)}
+}
+
+// Transfer sends the messages and records the transaction.
+func (r *I2cRecorder) Transfer(msgs []I2cMsg) error {
+	start := time.Now()
+	err := r.t.Transfer(msgs)
+	rec := I2cRecord{Duration: time.Since(start)}
+	for _, m := range msgs {
+		rec.Msgs = append(rec.Msgs, I2cRecordMsg{Addr: m.Addr, Flags: m.Flags, Len: len(m.Buf), Data: hex.EncodeToString(m.Buf)})
+	}
+	if err != nil {
+		rec.Err = err.Error()
+		var errno syscall.Errno
+		if errors.As(err, &errno) {
+			rec.Errno = int(errno)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if werr := r.e.Encode(&rec); werr != nil && err == nil {
+		err = fmt.Errorf("record: %w", werr)
+	}
+	return err
+}
+
+// Close closes the transport and the writer.
+func (r *I2cRecorder) Close() error {
+	err := r.t.Close()
+	if c, ok := r.w.(stdio.Closer); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// I2cReplay is a transport that returns the results of recorded
+// transactions. Each transaction must match the next recorded
+// transaction, otherwise an error matching ErrDiverged is returned,
+// and all following transactions fail.
+type I2cReplay struct {
+	mu   sync.Mutex
+	recs []I2cRecord
+	next int
+	err  error // First divergence
+}
+
+// NewI2cReplay reads the recorded transactions.
+func NewI2cReplay(rd stdio.Reader) (*I2cReplay, error) {
+	r := new(I2cReplay)
+	s := bufio.NewScanner(rd)
+	s.Buffer(nil, 1024*1024)
+	for line := 1; s.Scan(); line++ {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+		var rec I2cRecord
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("replay: line %d: %w", line, err)
+		}
+		r.recs = append(r.recs, rec)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Transfer checks the messages against the next recorded transaction,
+// and returns the recorded read data and error.
+func (r *I2cReplay) Transfer(msgs []I2cMsg) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	if r.next >= len(r.recs) {
+		r.err = fmt.Errorf("replay: transaction %d: %w: no more transactions recorded", r.next+1, ErrDiverged)
+		return r.err
+	}
+	rec := &r.recs[r.next]
+	r.next++
+	if err := r.match(rec, msgs); err != nil {
+		r.err = fmt.Errorf("replay: transaction %d: %w: %v", r.next, ErrDiverged, err)
+		return r.err
+	}
+	for i, rm := range rec.Msgs {
+		if rm.Flags&I2cFlagRead != 0 {
+			// Checked by match.
+			b, _ := hex.DecodeString(rm.Data)
+			copy(msgs[i].Buf, b)
+		}
+	}
+	if rec.Errno != 0 {
+		return syscall.Errno(rec.Errno)
+	}
+	if rec.Err != "" {
+		return errors.New(rec.Err)
+	}
+	return nil
+}
+
+// match compares the messages with the recorded messages.
+func (r *I2cReplay) match(rec *I2cRecord, msgs []I2cMsg) error {
+	if len(rec.Msgs) != len(msgs) {
+		return fmt.Errorf("%d messages, recorded %d", len(msgs), len(rec.Msgs))
+	}
+	for i, rm := range rec.Msgs {
+		m := msgs[i]
+		if m.Addr != rm.Addr || m.Flags != rm.Flags || len(m.Buf) != rm.Len {
+			return fmt.Errorf("message %d: addr 0x%02x flags 0x%x len %d, recorded addr 0x%02x flags 0x%x len %d",
+				i, m.Addr, m.Flags, len(m.Buf), rm.Addr, rm.Flags, rm.Len)
+		}
+		b, err := hex.DecodeString(rm.Data)
+		if err != nil || len(b) != rm.Len {
+			return fmt.Errorf("message %d: invalid recorded data %q", i, rm.Data)
+		}
+		if m.Flags&I2cFlagRead == 0 && string(b) != string(m.Buf) {
+			return fmt.Errorf("message %d: wrote %x, recorded %x", i, m.Buf, b)
+		}
+	}
+	return nil
+}
+
+// Close returns an error if a transaction diverged, or if not all of
+// the recorded transactions were replayed.
+func (r *I2cReplay) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	if r.next != len(r.recs) {
+		return fmt.Errorf("replay: %w: %d of %d transactions replayed", ErrDiverged, r.next, len(r.recs))
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package io
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// fakeTransport is a transport using a fake adapter.
+type fakeTransport struct {
+	f      *fakeI2c
+	closed bool
+}
+
+func (t *fakeTransport) Transfer(msgs []I2cMsg) error {
+	return t.f.transfer(msgs)
+}
+
+func (t *fakeTransport) Close() error {
+	t.closed = true
+	return nil
+}
+
+// session performs the transactions that are recorded and replayed.
+func session(t *testing.T, i2 *I2C) {
+	t.Helper()
+	if err := i2.Addr(0x48); err != nil {
+		t.Fatal(err)
+	}
+	if err := i2.WriteReg(0x01, 0x83); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := i2.ReadU16BE(0x00); err != nil || v != 0x1234 {
+		t.Errorf("ReadU16BE: got 0x%x, %v, want 0x1234", v, err)
+	}
+	if err := i2.Addr(0x49); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := i2.ReadReg(0x00); !errors.Is(err, ErrNoAck) || !errors.Is(err, unix.ENXIO) {
+		t.Errorf("ReadReg of missing device: got %v, want ENXIO", err)
+	}
+}
+
+func TestI2cRecord(t *testing.T) {
+	ft := &fakeTransport{f: &fakeI2c{present: map[uint16]bool{0x48: true}, reply: []byte{0x12, 0x34}}}
+	var buf bytes.Buffer
+	i2, err := NewI2cTransport(NewI2cRecorder(ft, &buf), "record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session(t, i2)
+	if err := i2.CloseErr(); err != nil {
+		t.Fatalf("CloseErr: %v", err)
+	}
+	if !ft.closed {
+		t.Error("transport not closed")
+	}
+	if n := strings.Count(buf.String(), "\n"); n != 3 {
+		t.Errorf("got %d records, want 3:\n%s", n, buf.String())
+	}
+	rec := buf.String()
+
+	// The replay returns the recorded data and errors.
+	r, err := NewI2cReplay(strings.NewReader(rec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i2, err = NewI2cTransport(r, "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session(t, i2)
+	if err := i2.CloseErr(); err != nil {
+		t.Errorf("replay CloseErr: %v", err)
+	}
+
+	// A different transaction diverges, and so do all the following ones.
+	r, err = NewI2cReplay(strings.NewReader(rec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i2, err = NewI2cTransport(r, "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := i2.Addr(0x48); err != nil {
+		t.Fatal(err)
+	}
+	if err := i2.WriteReg(0x01, 0x84); !errors.Is(err, ErrDiverged) {
+		t.Errorf("WriteReg: got %v, want ErrDiverged", err)
+	}
+	if _, err := i2.ReadU16BE(0x00); !errors.Is(err, ErrDiverged) {
+		t.Errorf("ReadU16BE after divergence: got %v, want ErrDiverged", err)
+	}
+	if err := i2.CloseErr(); !errors.Is(err, ErrDiverged) {
+		t.Errorf("CloseErr: got %v, want ErrDiverged", err)
+	}
+}
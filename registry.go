@@ -0,0 +1,122 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Process wide registry of the pins and devices that are in use.
+
+package io
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// BusyError is returned when a resource is already held by another consumer.
+// It matches ErrBusy when used with errors.Is.
+type BusyError struct {
+	Resource string // Resource requested e.g "gpiochip0/17", "i2c-1/0x48"
+	Consumer string // Consumer holding the resource
+}
+
+func (e *BusyError) Error() string {
+	return fmt.Sprintf("%s: %v (held by %q)", e.Resource, ErrBusy, e.Consumer)
+}
+
+// Is reports whether the target is ErrBusy.
+func (e *BusyError) Is(target error) bool {
+	return target == ErrBusy
+}
+
+// Allocation describes a resource that is held.
+type Allocation struct {
+	Resource string
+	Consumer string
+	Refs     int // Number of opens sharing the resource
+}
+
+type allocation struct {
+	consumer string
+	shared   bool
+	refs     int
+}
+
+var registry = struct {
+	sync.Mutex
+	res map[string]*allocation
+}{res: make(map[string]*allocation)}
+
+// reserve records that a resource is held by the consumer.
+// If the resource is already held, a BusyError is returned, unless both
+// opens allow sharing and are from the same consumer, in which case
+// the reference count is incremented.
+func reserve(res, consumer string, shared bool) error {
+	_, err := reserveRef(res, consumer, shared)
+	return err
+}
+
+// reserveRef is reserve, and also returns true if this is the
+// first reference to the resource.
+func reserveRef(res, consumer string, shared bool) (bool, error) {
+	registry.Lock()
+	defer registry.Unlock()
+	a, ok := registry.res[res]
+	if !ok {
+		registry.res[res] = &allocation{consumer: consumer, shared: shared, refs: 1}
+		return true, nil
+	}
+	if !a.shared || !shared || a.consumer != consumer {
+		return false, &BusyError{Resource: res, Consumer: a.consumer}
+	}
+	a.refs++
+	return false, nil
+}
+
+// release drops a reference to a resource, and returns true if
+// it was the last reference.
+func release(res string) bool {
+	registry.Lock()
+	defer registry.Unlock()
+	a, ok := registry.res[res]
+	if !ok {
+		return true
+	}
+	a.refs--
+	if a.refs > 0 {
+		return false
+	}
+	delete(registry.res, res)
+	return true
+}
+
+// refs returns the number of references to a resource.
+func refs(res string) int {
+	registry.Lock()
+	defer registry.Unlock()
+	if a, ok := registry.res[res]; ok {
+		return a.refs
+	}
+	return 0
+}
+
+// Allocations returns the resources currently held, sorted by resource name.
+func Allocations() []Allocation {
+	registry.Lock()
+	defer registry.Unlock()
+	var al []Allocation
+	for r, a := range registry.res {
+		al = append(al, Allocation{Resource: r, Consumer: a.consumer, Refs: a.refs})
+	}
+	sort.Slice(al, func(i, j int) bool { return al[i].Resource < al[j].Resource })
+	return al
+}
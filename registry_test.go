@@ -0,0 +1,182 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package io
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aamcrae/gpio/sysfstest"
+)
+
+// newSysfs creates an emulated sysfs tree under the root, or under a
+// new directory if the root is empty.
+func newSysfs(t *testing.T, root string) *sysfstest.Sysfs {
+	if root == "" {
+		root = t.TempDir()
+	}
+	fs, err := sysfstest.New(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldRoot, oldVerify, oldPoll := Root, Verify, poll
+	Root, Verify, poll = fs.Root(), true, fs.Poll
+	t.Cleanup(func() {
+		Root, Verify, poll = oldRoot, oldVerify, oldPoll
+		fs.Close()
+	})
+	return fs
+}
+
+// waitAttr waits for an emulated attribute to have a value.
+func waitAttr(t *testing.T, get func(int) (string, error), gpio int, want string) {
+	t.Helper()
+	for end := time.Now().Add(2 * time.Second); ; time.Sleep(time.Millisecond) {
+		if v, err := get(gpio); err == nil && v == want {
+			return
+		}
+		if time.Now().After(end) {
+			t.Fatalf("gpio%d: timed out waiting for %q", gpio, want)
+		}
+	}
+}
+
+func TestPinShared(t *testing.T) {
+	fs := newSysfs(t, "")
+	// Opens without a consumer label are not shared.
+	p, err := OutputPin(17)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitAttr(t, fs.Direction, 17, "out")
+	if _, err := Pin(17); !errors.Is(err, ErrBusy) {
+		t.Errorf("second bare open: got %v, want ErrBusy", err)
+	}
+	if err := p.Set(1); err != nil {
+		t.Errorf("Set after failed open: %v", err)
+	}
+	p.Close()
+	if len(Allocations()) != 0 {
+		t.Fatalf("allocations after close: %v", Allocations())
+	}
+
+	// Opens with the same label are shared, and do not change the pin.
+	p1, err := OutputPin(18, Consumer("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p1.Set(1); err != nil {
+		t.Fatal(err)
+	}
+	waitAttr(t, fs.Direction, 18, "out")
+	p2, err := OutputPin(18, Consumer("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := p2.Get(); err != nil || v != 1 {
+		t.Errorf("shared open: got %d, %v, want 1", v, err)
+	}
+	if _, err := Pin(18, Consumer("test")); !errors.Is(err, ErrBusy) {
+		t.Errorf("shared open as input: got %v, want ErrBusy", err)
+	}
+	if _, err := OutputPin(18, Consumer("test"), ActiveLow()); !errors.Is(err, ErrBusy) {
+		t.Errorf("shared open with ActiveLow: got %v, want ErrBusy", err)
+	}
+	var be *BusyError
+	if _, err := OutputPin(18, Consumer("other")); !errors.As(err, &be) || be.Consumer != "test" {
+		t.Errorf("open by another consumer: got %v, want BusyError held by test", err)
+	}
+	if a := Allocations(); len(a) != 1 || a[0].Refs != 2 {
+		t.Errorf("allocations: got %v, want 2 references", a)
+	}
+	p1.Close()
+	if !fs.Exported(18) {
+		t.Error("gpio18 unexported while still open")
+	}
+	if err := p2.Set(0); err != nil {
+		t.Errorf("Set on remaining open: %v", err)
+	}
+	p2.Close()
+	for end := time.Now().Add(2 * time.Second); fs.Exported(18); time.Sleep(time.Millisecond) {
+		if time.Now().After(end) {
+			t.Fatal("gpio18 not unexported on the last close")
+		}
+	}
+}
+
+func TestPinLineIdentity(t *testing.T) {
+	newFakeChip(t, 32)
+	newSysfs(t, Root)
+	// Describe a sysfs chip with base 512 whose character device is gpiochip0.
+	chip := filepath.Join(Root, gpioBaseDir, "gpiochip512")
+	if err := os.MkdirAll(filepath.Join(chip, "device", "gpiochip0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for f, v := range map[string]string{"base": "512\n", "ngpio": "32\n"} {
+		if err := os.WriteFile(filepath.Join(chip, f), []byte(v), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, err := OpenChip(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	l, err := c.Pin(5, Consumer("line"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var be *BusyError
+	if _, err := Pin(517); !errors.As(err, &be) || be.Resource != "gpiochip0/5" || be.Consumer != "line" {
+		t.Errorf("sysfs open of a held line: got %v, want BusyError for gpiochip0/5", err)
+	}
+	l.Close()
+	p, err := Pin(517)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Pin(5); !errors.Is(err, ErrBusy) {
+		t.Errorf("line request of a held pin: got %v, want ErrBusy", err)
+	}
+	p.Close()
+}
+
+func TestPinSharedSafe(t *testing.T) {
+	fs := newSysfs(t, "")
+	p1, err := OutputPin(19, Consumer("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitAttr(t, fs.Direction, 19, "out")
+	p2, err := OutputPin(19, Consumer("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p2.Close()
+	if err := p1.SafeValue(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := p2.Set(1); err != nil {
+		t.Fatal(err)
+	}
+	// Closing a shared open does not drive the safe value.
+	p1.Close()
+	if v, err := p2.Get(); err != nil || v != 1 {
+		t.Errorf("after closing a shared open: got %d, %v, want 1", v, err)
+	}
+}
@@ -0,0 +1,311 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package regmap provides access to the registers of a peripheral by
+// name, using a description of the registers and their bit fields.
+// The registers are accessed over a Bus, such as an I2C or SPI device.
+package regmap
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	gpio "github.com/aamcrae/gpio"
+)
+
+// Access mode
+const (
+	RW = iota // Default, read and write
+	RO = iota // Read only
+	WO = iota // Write only
+)
+
+var (
+	ErrReadOnly  = errors.New("register is read only")
+	ErrWriteOnly = errors.New("register is write only")
+	ErrUnknown   = errors.New("unknown register or field")
+)
+
+// Bus reads and writes consecutive registers of a device.
+type Bus interface {
+	ReadRegs(reg uint, b []byte) error
+	WriteRegs(reg uint, b []byte) error
+}
+
+// I2CBus accesses registers on an I2C device at the current default address.
+type I2CBus struct {
+	I2C    *gpio.I2C
+	Addr16 bool // Register addresses are 16 bits
+}
+
+// ReadRegs reads consecutive registers.
+func (b *I2CBus) ReadRegs(reg uint, buf []byte) error {
+	if b.Addr16 {
+		return b.I2C.Read16(uint16(reg), buf)
+	}
+	return b.I2C.Read(byte(reg), buf)
+}
+
+// WriteRegs writes consecutive registers.
+func (b *I2CBus) WriteRegs(reg uint, buf []byte) error {
+	if b.Addr16 {
+		return b.I2C.Write16(uint16(reg), buf)
+	}
+	return b.I2C.Write(byte(reg), buf)
+}
+
+// SpiTransferer performs multi-segment SPI transfers, such as gpio.Spi.
+type SpiTransferer interface {
+	Transfer(ts []gpio.SpiTransfer) error
+}
+
+// SpiBus accesses registers on a SPI device, where the first byte of the
+// transfer is the register address combined with a read or write flag.
+// Reads and writes are half duplex, so 3 wire devices are supported.
+type SpiBus struct {
+	Spi       SpiTransferer
+	ReadFlag  byte // Set in the address for reads, commonly 0x80
+	WriteFlag byte // Set in the address for writes
+}
+
+// ReadRegs reads consecutive registers.
+func (b *SpiBus) ReadRegs(reg uint, buf []byte) error {
+	return b.Spi.Transfer([]gpio.SpiTransfer{{Tx: []byte{byte(reg) | b.ReadFlag}}, {Rx: buf}})
+}
+
+// WriteRegs writes consecutive registers.
+func (b *SpiBus) WriteRegs(reg uint, buf []byte) error {
+	return b.Spi.Transfer([]gpio.SpiTransfer{{Tx: append([]byte{byte(reg) | b.WriteFlag}, buf...)}})
+}
+
+// Field is a named group of bits within a register.
+type Field struct {
+	Name  string
+	Shift uint // Bit number of the least significant bit
+	Bits  uint // Number of bits
+}
+
+// Register describes one register of a device.
+type Register struct {
+	Name         string
+	Addr         uint
+	Width        int // Width in bytes (1 to 4), default 1
+	Access       int
+	LittleEndian bool // Multi-byte registers are little endian
+	// Cached registers are read from the value last written (or Default),
+	// and are never read from the device, so caching is only suitable for
+	// write only registers, and configuration registers that the device
+	// does not change itself.
+	Cached  bool
+	Default uint32
+	Fields  []Field
+}
+
+// Map provides access to the registers of a device by name.
+type Map struct {
+	bus   Bus
+	mu    sync.Mutex
+	regs  []*Register
+	names map[string]*Register
+	cache map[string]uint32
+}
+
+// New creates a register map for the device on the bus.
+// Write only registers that are not cached can only be written as a
+// whole, and not by field.
+func New(bus Bus, regs []Register) (*Map, error) {
+	m := &Map{bus: bus, names: make(map[string]*Register), cache: make(map[string]uint32)}
+	for i := range regs {
+		r := regs[i]
+		if r.Width == 0 {
+			r.Width = 1
+		}
+		if r.Width < 1 || r.Width > 4 {
+			return nil, fmt.Errorf("%s: invalid width %d", r.Name, r.Width)
+		}
+		if r.Cached && r.Access == RO {
+			return nil, fmt.Errorf("%s: read only register cannot be cached", r.Name)
+		}
+		if _, ok := m.names[r.Name]; ok {
+			return nil, fmt.Errorf("%s: duplicate register", r.Name)
+		}
+		for _, f := range r.Fields {
+			if f.Bits == 0 || f.Shift+f.Bits > uint(r.Width*8) {
+				return nil, fmt.Errorf("%s.%s: field outside register", r.Name, f.Name)
+			}
+		}
+		m.regs = append(m.regs, &r)
+		m.names[r.Name] = &r
+		if r.Cached {
+			m.cache[r.Name] = r.Default
+		}
+	}
+	return m, nil
+}
+
+// Read returns the value of the register.
+func (m *Map) Read(name string) (uint32, error) {
+	r, err := m.register(name)
+	if err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.read(r)
+}
+
+// Write writes the value to the register.
+func (m *Map) Write(name string, v uint32) error {
+	r, err := m.register(name)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.write(r, v)
+}
+
+// ReadField returns the value of a field of the register.
+func (m *Map) ReadField(name, field string) (uint32, error) {
+	r, f, err := m.field(name, field)
+	if err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, err := m.read(r)
+	if err != nil {
+		return 0, err
+	}
+	return (v >> f.Shift) & mask(f.Bits), nil
+}
+
+// WriteField performs a read-modify-write of the register, setting
+// the field to the value.
+func (m *Map) WriteField(name, field string, v uint32) error {
+	r, f, err := m.field(name, field)
+	if err != nil {
+		return err
+	}
+	if v > mask(f.Bits) {
+		return fmt.Errorf("%s.%s: value 0x%x too large", name, field, v)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	old, err := m.read(r)
+	if err != nil {
+		return err
+	}
+	fm := mask(f.Bits) << f.Shift
+	return m.write(r, old&^fm|v<<f.Shift)
+}
+
+// Dump prints all the readable registers and their fields.
+func (m *Map) Dump(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, r := range m.regs {
+		v, err := m.read(r)
+		if errors.Is(err, ErrWriteOnly) {
+			fmt.Fprintf(w, "%-16s (0x%02x) = <write only>\n", r.Name, r.Addr)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%-16s (0x%02x) = 0x%0*x\n", r.Name, r.Addr, r.Width*2, v)
+		for _, f := range r.Fields {
+			fmt.Fprintf(w, "    %-16s [%d:%d] = 0x%x\n", f.Name, f.Shift+f.Bits-1, f.Shift, (v>>f.Shift)&mask(f.Bits))
+		}
+	}
+	return nil
+}
+
+// read returns the register value, from the cache if the register is cached.
+func (m *Map) read(r *Register) (uint32, error) {
+	if r.Cached {
+		return m.cache[r.Name], nil
+	}
+	if r.Access == WO {
+		return 0, fmt.Errorf("%s: %w", r.Name, ErrWriteOnly)
+	}
+	b := make([]byte, r.Width)
+	if err := m.bus.ReadRegs(r.Addr, b); err != nil {
+		return 0, err
+	}
+	var v uint32
+	for i := range b {
+		if r.LittleEndian {
+			v |= uint32(b[i]) << (8 * uint(i))
+		} else {
+			v = v<<8 | uint32(b[i])
+		}
+	}
+	return v, nil
+}
+
+// write writes the register, updating the cache if the register is cached.
+func (m *Map) write(r *Register, v uint32) error {
+	if r.Access == RO {
+		return fmt.Errorf("%s: %w", r.Name, ErrReadOnly)
+	}
+	if v > mask(uint(r.Width*8)) {
+		return fmt.Errorf("%s: value 0x%x too large", r.Name, v)
+	}
+	b := make([]byte, r.Width)
+	for i := range b {
+		s := 8 * uint(i)
+		if !r.LittleEndian {
+			s = 8 * uint(r.Width-1-i)
+		}
+		b[i] = byte(v >> s)
+	}
+	if err := m.bus.WriteRegs(r.Addr, b); err != nil {
+		return err
+	}
+	if r.Cached {
+		m.cache[r.Name] = v
+	}
+	return nil
+}
+
+// register returns the register with the name.
+func (m *Map) register(name string) (*Register, error) {
+	r, ok := m.names[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name, ErrUnknown)
+	}
+	return r, nil
+}
+
+// field returns the register and field with the names.
+func (m *Map) field(name, field string) (*Register, *Field, error) {
+	r, err := m.register(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range r.Fields {
+		if r.Fields[i].Name == field {
+			return r, &r.Fields[i], nil
+		}
+	}
+	return nil, nil, fmt.Errorf("%s.%s: %w", name, field, ErrUnknown)
+}
+
+// mask returns a mask of the number of bits.
+func mask(bits uint) uint32 {
+	return uint32(uint64(1)<<bits - 1)
+}
@@ -0,0 +1,313 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package regmap_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aamcrae/gpio"
+	"github.com/aamcrae/gpio/regmap"
+)
+
+// recording is a recorded session with a device at 0x48, which reads
+// the 16 bit config register (0x01), and then clears the mode field
+// with a read and a write of the register.
+const recording = `
+{"msgs":[{"addr":72,"flags":0,"len":1,"data":"01"},{"addr":72,"flags":1,"len":2,"data":"8583"}],"duration":100000}
+{"msgs":[{"addr":72,"flags":0,"len":1,"data":"01"},{"addr":72,"flags":1,"len":2,"data":"8583"}],"duration":100000}
+{"msgs":[{"addr":72,"flags":0,"len":3,"data":"018483"}],"duration":100000}
+`
+
+var regs = []regmap.Register{
+	{Name: "config", Addr: 0x01, Width: 2, Fields: []regmap.Field{{Name: "mode", Shift: 8, Bits: 1}}},
+}
+
+// replay creates a bus that replays the transactions.
+func replay(t *testing.T, rec string) (*io.I2C, *regmap.Map) {
+	r, err := io.NewI2cReplay(strings.NewReader(rec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i2, err := io.NewI2cTransport(r, "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { i2.Close() })
+	if err := i2.Addr(0x48); err != nil {
+		t.Fatal(err)
+	}
+	m, err := regmap.New(&regmap.I2CBus{I2C: i2}, regs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return i2, m
+}
+
+func TestReplay(t *testing.T) {
+	i2, m := replay(t, recording)
+	if v, err := m.Read("config"); err != nil || v != 0x8583 {
+		t.Errorf("Read config: got 0x%x, %v, want 0x8583", v, err)
+	}
+	if err := m.WriteField("config", "mode", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := i2.CloseErr(); err != nil {
+		t.Errorf("CloseErr: %v", err)
+	}
+	if err := i2.CloseErr(); err != nil {
+		t.Errorf("second CloseErr: %v", err)
+	}
+}
+
+func TestReplayDiverged(t *testing.T) {
+	i2, m := replay(t, recording)
+	if _, err := m.Read("config"); err != nil {
+		t.Fatal(err)
+	}
+	// Writing without the recorded read does not match the recording.
+	if err := m.Write("config", 0x8483); !errors.Is(err, io.ErrDiverged) {
+		t.Errorf("Write: got %v, want ErrDiverged", err)
+	}
+	if err := i2.CloseErr(); !errors.Is(err, io.ErrDiverged) {
+		t.Errorf("CloseErr: got %v, want ErrDiverged", err)
+	}
+}
+
+func TestReplayIncomplete(t *testing.T) {
+	i2, m := replay(t, recording)
+	if _, err := m.Read("config"); err != nil {
+		t.Fatal(err)
+	}
+	// Not all of the recorded transactions were replayed.
+	if err := i2.CloseErr(); !errors.Is(err, io.ErrDiverged) {
+		t.Errorf("CloseErr: got %v, want ErrDiverged", err)
+	}
+}
+
+// fakeBus is a device with 256 byte wide registers.
+type fakeBus struct {
+	regs   [256]byte
+	reads  int
+	writes int
+}
+
+func (b *fakeBus) ReadRegs(reg uint, buf []byte) error {
+	b.reads++
+	copy(buf, b.regs[reg:])
+	return nil
+}
+
+func (b *fakeBus) WriteRegs(reg uint, buf []byte) error {
+	b.writes++
+	copy(b.regs[reg:], buf)
+	return nil
+}
+
+var fieldRegs = []regmap.Register{
+	{Name: "ctrl", Addr: 0x10, Width: 2, Fields: []regmap.Field{
+		{Name: "low", Shift: 0, Bits: 4},
+		{Name: "mid", Shift: 4, Bits: 3},
+		{Name: "high", Shift: 12, Bits: 4},
+	}},
+	{Name: "count", Addr: 0x20, Width: 3, LittleEndian: true},
+	{Name: "id", Addr: 0x30, Access: regmap.RO},
+	{Name: "cmd", Addr: 0x31, Access: regmap.WO},
+	{Name: "mode", Addr: 0x32, Access: regmap.WO, Cached: true, Default: 0x12, Fields: []regmap.Field{
+		{Name: "rate", Shift: 4, Bits: 4},
+	}},
+}
+
+func newMap(t *testing.T) (*fakeBus, *regmap.Map) {
+	b := &fakeBus{}
+	m, err := regmap.New(b, fieldRegs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, m
+}
+
+func TestFields(t *testing.T) {
+	b, m := newMap(t)
+	if err := m.Write("ctrl", 0xA5C3); err != nil {
+		t.Fatal(err)
+	}
+	if b.regs[0x10] != 0xA5 || b.regs[0x11] != 0xC3 {
+		t.Errorf("ctrl bytes: got % x, want a5 c3", b.regs[0x10:0x12])
+	}
+	for _, f := range []struct {
+		name string
+		want uint32
+	}{{"low", 0x3}, {"mid", 0x4}, {"high", 0xA}} {
+		if v, err := m.ReadField("ctrl", f.name); err != nil || v != f.want {
+			t.Errorf("ReadField %s: got 0x%x, %v, want 0x%x", f.name, v, err, f.want)
+		}
+	}
+	if err := m.WriteField("ctrl", "mid", 0x5); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := m.Read("ctrl"); err != nil || v != 0xA5D3 {
+		t.Errorf("after WriteField: got 0x%x, %v, want 0xa5d3", v, err)
+	}
+	if err := m.WriteField("ctrl", "mid", 0x8); err == nil {
+		t.Error("WriteField with a value too large: no error")
+	}
+	if _, err := m.ReadField("ctrl", "none"); !errors.Is(err, regmap.ErrUnknown) {
+		t.Errorf("ReadField unknown: got %v, want ErrUnknown", err)
+	}
+	if _, err := m.Read("none"); !errors.Is(err, regmap.ErrUnknown) {
+		t.Errorf("Read unknown: got %v, want ErrUnknown", err)
+	}
+	// Multi-byte registers may be little endian.
+	if err := m.Write("count", 0x123456); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b.regs[0x20:0x23], []byte{0x56, 0x34, 0x12}) {
+		t.Errorf("count bytes: got % x, want 56 34 12", b.regs[0x20:0x23])
+	}
+	if v, err := m.Read("count"); err != nil || v != 0x123456 {
+		t.Errorf("Read count: got 0x%x, %v", v, err)
+	}
+	// Values wider than the register are not written.
+	writes := b.writes
+	if err := m.Write("count", 0x1000000); err == nil {
+		t.Error("Write with a value too large: no error")
+	}
+	if err := m.Write("ctrl", 0x10000); err == nil {
+		t.Error("Write with a value too large: no error")
+	}
+	if b.writes != writes {
+		t.Errorf("value too large was written")
+	}
+}
+
+func TestAccess(t *testing.T) {
+	b, m := newMap(t)
+	b.regs[0x30] = 0x5A
+	if v, err := m.Read("id"); err != nil || v != 0x5A {
+		t.Errorf("Read id: got 0x%x, %v", v, err)
+	}
+	if err := m.Write("id", 1); !errors.Is(err, regmap.ErrReadOnly) {
+		t.Errorf("Write read only: got %v, want ErrReadOnly", err)
+	}
+	if err := m.Write("cmd", 0x7); err != nil || b.regs[0x31] != 0x7 {
+		t.Errorf("Write cmd: got %v, 0x%x", err, b.regs[0x31])
+	}
+	if _, err := m.Read("cmd"); !errors.Is(err, regmap.ErrWriteOnly) {
+		t.Errorf("Read write only: got %v, want ErrWriteOnly", err)
+	}
+	// Write only registers can only be written by field if cached.
+	if err := m.WriteField("mode", "rate", 1); err != nil {
+		t.Errorf("WriteField cached: %v", err)
+	}
+	if _, err := regmap.New(b, []regmap.Register{{Name: "id", Access: regmap.RO, Cached: true}}); err == nil {
+		t.Error("cached read only register: no error")
+	}
+}
+
+func TestCache(t *testing.T) {
+	b, m := newMap(t)
+	// The default is returned without reading the device.
+	if v, err := m.Read("mode"); err != nil || v != 0x12 {
+		t.Errorf("Read mode: got 0x%x, %v, want the default 0x12", v, err)
+	}
+	if err := m.WriteField("mode", "rate", 0x3); err != nil {
+		t.Fatal(err)
+	}
+	if b.regs[0x32] != 0x32 {
+		t.Errorf("mode written: got 0x%x, want 0x32", b.regs[0x32])
+	}
+	if v, err := m.ReadField("mode", "rate"); err != nil || v != 0x3 {
+		t.Errorf("ReadField rate: got 0x%x, %v", v, err)
+	}
+	// A failed write does not change the cache.
+	if err := m.Write("mode", 0x100); err == nil {
+		t.Error("Write with a value too large: no error")
+	}
+	if v, err := m.Read("mode"); err != nil || v != 0x32 {
+		t.Errorf("Read mode: got 0x%x, %v, want 0x32", v, err)
+	}
+	if b.reads != 0 {
+		t.Errorf("cached register read %d times from the device", b.reads)
+	}
+}
+
+func TestDump(t *testing.T) {
+	b, m := newMap(t)
+	copy(b.regs[0x10:], []byte{0xA5, 0xC3})
+	copy(b.regs[0x20:], []byte{0x56, 0x34, 0x12})
+	b.regs[0x30] = 0x5A
+	var out strings.Builder
+	if err := m.Dump(&out); err != nil {
+		t.Fatal(err)
+	}
+	want := `ctrl             (0x10) = 0xa5c3
+    low              [3:0] = 0x3
+    mid              [6:4] = 0x4
+    high             [15:12] = 0xa
+count            (0x20) = 0x123456
+id               (0x30) = 0x5a
+cmd              (0x31) = <write only>
+mode             (0x32) = 0x12
+    rate             [7:4] = 0x1
+`
+	if out.String() != want {
+		t.Errorf("Dump: got\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+// fakeSpi records the transfers, and replies to reads.
+type fakeSpi struct {
+	ts    [][]io.SpiTransfer
+	reply []byte
+}
+
+func (s *fakeSpi) Transfer(ts []io.SpiTransfer) error {
+	for _, t := range ts {
+		copy(t.Rx, s.reply)
+	}
+	s.ts = append(s.ts, ts)
+	return nil
+}
+
+func TestSpiBus(t *testing.T) {
+	s := &fakeSpi{reply: []byte{0x12, 0x34}}
+	m, err := regmap.New(&regmap.SpiBus{Spi: s, ReadFlag: 0x80, WriteFlag: 0x40}, []regmap.Register{
+		{Name: "data", Addr: 0x0F, Width: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := m.Read("data"); err != nil || v != 0x1234 {
+		t.Errorf("Read: got 0x%x, %v, want 0x1234", v, err)
+	}
+	if err := m.Write("data", 0xABCD); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.ts) != 2 {
+		t.Fatalf("got %d transfers, want 2", len(s.ts))
+	}
+	// The read sends the address, and then reads the data half duplex.
+	rd := s.ts[0]
+	if len(rd) != 2 || !bytes.Equal(rd[0].Tx, []byte{0x8F}) || rd[0].Rx != nil || rd[1].Tx != nil || len(rd[1].Rx) != 2 {
+		t.Errorf("read transfer: got %+v", rd)
+	}
+	wr := s.ts[1]
+	if len(wr) != 1 || !bytes.Equal(wr[0].Tx, []byte{0x4F, 0xAB, 0xCD}) || wr[0].Rx != nil {
+		t.Errorf("write transfer: got %+v", wr)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Driving outputs to a safe state on exit, signals and panics.
+
+package io
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// Safe is implemented by outputs that can be driven to a safe state.
+type Safe interface {
+	Safe() error
+}
+
+// SafeSetter is a Safe that sets a Setter (such as a simulated pin)
+// to a safe value.
+type SafeSetter struct {
+	Setter
+	Value int
+}
+
+// Safe sets the safe value.
+func (s *SafeSetter) Safe() error {
+	return s.Set(s.Value)
+}
+
+var safeList = struct {
+	sync.Mutex
+	s []Safe
+}{}
+
+// RegisterSafe registers an output so that it is driven to its safe state
+// by SafeState. Registering an output more than once has no effect.
+func RegisterSafe(s Safe) {
+	safeList.Lock()
+	defer safeList.Unlock()
+	for _, e := range safeList.s {
+		if e == s {
+			return
+		}
+	}
+	safeList.s = append(safeList.s, s)
+}
+
+// UnregisterSafe removes an output from the safe state list.
+func UnregisterSafe(s Safe) {
+	safeList.Lock()
+	defer safeList.Unlock()
+	for i, e := range safeList.s {
+		if e == s {
+			safeList.s = append(safeList.s[:i], safeList.s[i+1:]...)
+			return
+		}
+	}
+}
+
+// SafeState drives all the registered outputs to their safe state,
+// in the reverse order to which they were registered.
+// All outputs are attempted, and the first error is returned.
+// Safe is called without the list locked, so an output that is
+// unregistered and closed concurrently may still have Safe called,
+// which should then have no effect.
+func SafeState() error {
+	safeList.Lock()
+	l := append([]Safe(nil), safeList.s...)
+	safeList.Unlock()
+	var err error
+	for i := len(l) - 1; i >= 0; i-- {
+		if e := l[i].Safe(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// HandleSignals installs a handler that calls SafeState when one of the
+// signals is received (SIGINT and SIGTERM if none are given), and then
+// removes the handler and resends the signal, so that the process exits
+// as it would have without the handler. If the application has also
+// requested the signal with signal.Notify, the process does not exit,
+// and the application receives the signal a second time once the
+// outputs are in their safe state. The returned function removes the
+// handler.
+func HandleSignals(sigs ...os.Signal) (stop func()) {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+	}
+	c := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(c, sigs...)
+	go func() {
+		select {
+		case sig := <-c:
+			SafeState()
+			signal.Stop(c)
+			if p, err := os.FindProcess(os.Getpid()); err == nil {
+				p.Signal(sig)
+			}
+		case <-done:
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(c)
+			close(done)
+		})
+	}
+}
+
+// RecoverSafe calls SafeState if the goroutine is panicking, and then
+// continues the panic. It should be deferred e.g
+//
+//	defer io.RecoverSafe()
+func RecoverSafe() {
+	if r := recover(); r != nil {
+		SafeState()
+		panic(r)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package io
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// safeFile records a call to Safe by writing to a file.
+type safeFile struct {
+	name string
+}
+
+func (s *safeFile) Safe() error {
+	return os.WriteFile(s.name, []byte("safe"), 0644)
+}
+
+// safeCount counts the calls to Safe.
+type safeCount struct {
+	n int
+}
+
+func (s *safeCount) Safe() error {
+	s.n++
+	return nil
+}
+
+func TestSafeDuty(t *testing.T) {
+	fs := newSysfs(t, "")
+	p, err := NewHwPWM(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SafeDuty(101); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("SafeDuty(101): got %v, want ErrInvalid", err)
+	}
+	if err := p.SafeDuty(25); err != nil {
+		t.Fatal(err)
+	}
+	dutyIs := func(duty int64) {
+		t.Helper()
+		for end := time.Now().Add(2 * time.Second); ; time.Sleep(time.Millisecond) {
+			if _, d, _, err := fs.Pwm(1); err == nil && d == duty {
+				return
+			}
+			if time.Now().After(end) {
+				t.Fatalf("timed out waiting for a duty cycle of %d", duty)
+			}
+		}
+	}
+	if err := p.Set(time.Millisecond, 80); err != nil {
+		t.Fatal(err)
+	}
+	dutyIs(800000)
+	// The safe duty cycle keeps the current period.
+	if err := SafeState(); err != nil {
+		t.Fatal(err)
+	}
+	dutyIs(250000)
+	if err := p.Set(time.Millisecond, 60); err != nil {
+		t.Fatal(err)
+	}
+	dutyIs(600000)
+	p.Close()
+	// The PWM is no longer registered once closed.
+	c := &safeCount{}
+	RegisterSafe(c)
+	defer UnregisterSafe(c)
+	if err := SafeState(); err != nil || c.n != 1 {
+		t.Errorf("SafeState after Close: got %v, %d calls", err, c.n)
+	}
+}
+
+func TestRecoverSafe(t *testing.T) {
+	c := &safeCount{}
+	RegisterSafe(c)
+	defer UnregisterSafe(c)
+	run := func(f func()) (r interface{}) {
+		defer func() {
+			r = recover()
+		}()
+		defer RecoverSafe()
+		f()
+		return nil
+	}
+	if r := run(func() {}); r != nil || c.n != 0 {
+		t.Errorf("no panic: got %v, %d calls", r, c.n)
+	}
+	if r := run(func() { panic("failed") }); r != "failed" || c.n != 1 {
+		t.Errorf("panic: got %v, %d calls, want the panic continued after 1 call", r, c.n)
+	}
+}
+
+// TestHandleSignals runs itself as a child process that signals itself.
+func TestHandleSignals(t *testing.T) {
+	if name := os.Getenv("IO_TEST_SAFE_FILE"); name != "" {
+		RegisterSafe(&safeFile{name})
+		var app chan os.Signal
+		if os.Getenv("IO_TEST_NOTIFY") != "" {
+			app = make(chan os.Signal, 2)
+			signal.Notify(app, syscall.SIGTERM)
+		}
+		HandleSignals(syscall.SIGTERM)
+		syscall.Kill(os.Getpid(), syscall.SIGTERM)
+		n := 0
+		for timeout := time.After(time.Second); ; {
+			select {
+			case <-app:
+				n++
+				continue
+			case <-timeout:
+			}
+			break
+		}
+		fmt.Printf("received %d\n", n)
+		os.Exit(0)
+	}
+	for _, notify := range []bool{false, true} {
+		name := filepath.Join(t.TempDir(), "safe")
+		cmd := exec.Command(os.Args[0], "-test.run=^TestHandleSignals$")
+		cmd.Env = append(os.Environ(), "IO_TEST_SAFE_FILE="+name)
+		if notify {
+			cmd.Env = append(cmd.Env, "IO_TEST_NOTIFY=1")
+		}
+		out, err := cmd.Output()
+		if notify {
+			// The application handles the signal, and receives it twice.
+			if err != nil || string(out) != "received 2\n" {
+				t.Errorf("with Notify: got %q, %v, want the signal received twice", out, err)
+			}
+		} else {
+			var ee *exec.ExitError
+			if !errors.As(err, &ee) {
+				t.Fatalf("child: got %v, want exit by signal", err)
+			}
+			if ws := ee.Sys().(syscall.WaitStatus); !ws.Signaled() || ws.Signal() != syscall.SIGTERM {
+				t.Errorf("child exit: got %v, want SIGTERM", ws)
+			}
+		}
+		if b, err := os.ReadFile(name); err != nil || string(b) != "safe" {
+			t.Errorf("safe state not set: %q, %v", b, err)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Scanning an I2C bus for devices.
+
+package io
+
+import (
+	"errors"
+)
+
+// Range of addresses scanned. Addresses outside this range are reserved.
+const (
+	I2cScanFirst = 0x08
+	I2cScanLast  = 0x77
+)
+
+// Probe reports whether a device acknowledges the address selected.
+// As with i2cdetect, a quick write is used, except for the address ranges
+// of EEPROMs and write only devices where a quick write may corrupt the
+// device, for which a read byte is used. The probe falls back to a read
+// byte if the adapter does not support quick writes.
+// If the address is in use by a kernel driver, false is returned with
+// an error that matches ErrBusy.
+// The default address is not changed or reserved.
+func (i2 *I2C) Probe(addr uint16) (bool, error) {
+	read := (addr >= 0x30 && addr <= 0x37) || (addr >= 0x50 && addr <= 0x5F)
+	var err error
+	switch {
+	case !read && i2.funcs&i2cFuncSmbusQuick != 0:
+		err = i2.smbusAddr(addr, "probe", smbusWrite, 0, smbusQuick, nil)
+	case i2.funcs&i2cFuncSmbusReadByte != 0:
+		var d i2c_smbus_data
+		err = i2.smbusAddr(addr, "probe", smbusRead, 0, smbusByte, &d)
+	case i2.funcs&i2cFuncI2c != 0:
+		m := []I2cMsg{{Addr: addr}}
+		if read {
+			m[0].Flags = I2cFlagRead
+			m[0].Buf = make([]byte, 1)
+		}
+		err = i2.Message(m)
+	default:
+		return false, busError(i2.name(), int(addr), "probe", ErrNotSupported)
+	}
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, ErrNoAck) || errors.Is(err, ErrTimeout) {
+		return false, nil
+	}
+	return false, err
+}
+
+// ScanBus probes the non-reserved addresses of the bus, and returns the
+// addresses of the devices that respond, including those that are in use
+// by a kernel driver.
+func ScanBus(i2 *I2C) ([]uint16, error) {
+	var found []uint16
+	for addr := uint16(I2cScanFirst); addr <= I2cScanLast; addr++ {
+		ok, err := i2.Probe(addr)
+		if errors.Is(err, ErrBusy) {
+			ok, err = true, nil
+		}
+		if err != nil {
+			return found, err
+		}
+		if ok {
+			found = append(found, addr)
+		}
+	}
+	return found, nil
+}
@@ -0,0 +1,107 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package io
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// isRead reports whether the address is probed with a read byte.
+func isRead(addr uint16) bool {
+	return (addr >= 0x30 && addr <= 0x37) || (addr >= 0x50 && addr <= 0x5F)
+}
+
+func TestProbeSmbus(t *testing.T) {
+	i2, f := newFakeI2c(i2cFuncI2c | i2cFuncSmbusQuick | i2cFuncSmbusReadByte)
+	f.present = map[uint16]bool{0x20: true, 0x50: true}
+	for _, tc := range []struct {
+		addr uint16
+		ok   bool
+	}{{0x20, true}, {0x21, false}, {0x50, true}, {0x35, false}} {
+		f.cmds = nil
+		ok, err := i2.Probe(tc.addr)
+		if err != nil || ok != tc.ok {
+			t.Errorf("Probe(0x%02x): got %v, %v, want %v", tc.addr, ok, err, tc.ok)
+		}
+		if len(f.cmds) != 1 {
+			t.Fatalf("Probe(0x%02x): %d commands", tc.addr, len(f.cmds))
+		}
+		c := f.cmds[0]
+		// EEPROMs and write only devices are probed with a read byte.
+		want := fakeSmbus{addr: tc.addr, rw: smbusWrite, size: smbusQuick}
+		if isRead(tc.addr) {
+			want = fakeSmbus{addr: tc.addr, rw: smbusRead, size: smbusByte}
+		}
+		if c.addr != want.addr || c.rw != want.rw || c.size != want.size {
+			t.Errorf("Probe(0x%02x): got %+v, want %+v", tc.addr, c, want)
+		}
+	}
+	if len(f.xfers) != 0 {
+		t.Errorf("SMBus probes used %d transfers", len(f.xfers))
+	}
+	// Without quick writes, a read byte is used.
+	i2.funcs = i2cFuncSmbusReadByte
+	f.cmds = nil
+	if ok, err := i2.Probe(0x20); !ok || err != nil || f.cmds[0].size != smbusByte {
+		t.Errorf("Probe without quick: got %v, %v, %+v", ok, err, f.cmds)
+	}
+}
+
+func TestProbeI2c(t *testing.T) {
+	i2, f := newFakeI2c(i2cFuncI2c)
+	f.present = map[uint16]bool{0x20: true, 0x50: true}
+	if ok, err := i2.Probe(0x20); !ok || err != nil {
+		t.Errorf("Probe(0x20): got %v, %v", ok, err)
+	}
+	if ok, err := i2.Probe(0x51); ok || err != nil {
+		t.Errorf("Probe(0x51): got %v, %v", ok, err)
+	}
+	want := [][]I2cMsg{
+		{{Addr: 0x20}},
+		{{Addr: 0x51, Flags: I2cFlagRead, Buf: []byte{0}}},
+	}
+	checkXfers(t, f.xfers, want)
+	i2.funcs = 0
+	if _, err := i2.Probe(0x20); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("Probe without support: got %v, want ErrNotSupported", err)
+	}
+}
+
+func TestScanBus(t *testing.T) {
+	i2, f := newFakeI2c(i2cFuncI2c | i2cFuncSmbusQuick | i2cFuncSmbusReadByte)
+	// Devices at reserved addresses are not found.
+	f.present = map[uint16]bool{0x03: true, 0x08: true, 0x3C: true, 0x50: true, 0x77: true, 0x78: true}
+	f.busy = map[uint16]bool{0x68: true}
+	found, err := ScanBus(i2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint16{0x08, 0x3C, 0x50, 0x68, 0x77}; !reflect.DeepEqual(found, want) {
+		t.Errorf("ScanBus: got %x, want %x", found, want)
+	}
+	if len(f.cmds) != I2cScanLast-I2cScanFirst+1 {
+		t.Errorf("ScanBus: %d probes, want %d", len(f.cmds), I2cScanLast-I2cScanFirst+1)
+	}
+	for _, c := range f.cmds {
+		if c.addr < I2cScanFirst || c.addr > I2cScanLast {
+			t.Errorf("reserved address 0x%02x probed", c.addr)
+		}
+		if isRead(c.addr) != (c.size == smbusByte) {
+			t.Errorf("address 0x%02x probed with size %d", c.addr, c.size)
+		}
+	}
+}
@@ -15,6 +15,8 @@
 package sensor
 
 import (
+	"context"
+	"errors"
 	"time"
 
 	"github.com/aamcrae/gpio"
@@ -27,12 +29,12 @@ import (
 // discharge through the sensor. The faster the discharge time, the
 // stronger the reflected signal.
 type Proximity struct {
-	pin      *io.Gpio // Pin for reading and controlling reader.
-	Min, Max int      // For range checks
+	pin      io.GpioPin // Pin for reading and controlling reader.
+	Min, Max int        // For range checks
 }
 
 // NewProximity creates and initialises a Proximity struct.
-func NewProximity(pin *io.Gpio) *Proximity {
+func NewProximity(pin io.GpioPin) *Proximity {
 	p := &Proximity{pin, 100, 5000}
 	p.pin.Direction(io.IN)
 	p.pin.Edge(io.FALLING)
@@ -43,14 +45,23 @@ func NewProximity(pin *io.Gpio) *Proximity {
 // then turning it off, and detecting how long the capacitor takes to drain.
 // The duration is returned as the number of microseconds.
 func (p *Proximity) Read() (int, error) {
+	return p.ReadContext(context.Background())
+}
+
+// ReadContext is the same as Read, but returns early with the context
+// error if the context is done.
+func (p *Proximity) ReadContext(ctx context.Context) (int, error) {
 	for retries := 0; retries < 5; retries++ {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
 		p.pin.Direction(io.OUT)
 		p.pin.Set(1)
 		time.Sleep(time.Microsecond * 100)
 		now := time.Now()
 		p.pin.Direction(io.IN)
 		for {
-			v, err := p.pin.GetTimeout(time.Millisecond * 20)
+			v, err := p.get(ctx, time.Millisecond*20)
 			if err != nil {
 				return 0, err
 			}
@@ -66,3 +77,20 @@ func (p *Proximity) Read() (int, error) {
 	}
 	return 0, io.ErrRetriesExceeded
 }
+
+// get waits for an edge on the pin, using the context if the pin supports it.
+// A context that can never be done needs no watching, so GetTimeout is used.
+func (p *Proximity) get(ctx context.Context, tout time.Duration) (int, error) {
+	cg, ok := p.pin.(io.ContextGetter)
+	if !ok || ctx.Done() == nil {
+		return p.pin.GetTimeout(tout)
+	}
+	tctx, cancel := context.WithTimeout(ctx, tout)
+	defer cancel()
+	v, err := cg.GetContext(tctx)
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		// Report the timeout the same way as GetTimeout.
+		return 0, io.ErrTimeout
+	}
+	return v, err
+}
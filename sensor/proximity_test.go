@@ -0,0 +1,135 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sensor_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aamcrae/gpio"
+	"github.com/aamcrae/gpio/sensor"
+	"github.com/aamcrae/gpio/sim"
+)
+
+// discharge simulates the sensor capacitor, which discharges after the
+// delay once the pin is switched to an input after being charged.
+func discharge(c *sim.Chip, n int, delay time.Duration) {
+	c.Observe(n, func(ch sim.Change) {
+		if ch.Direction == io.IN && ch.Level == 1 {
+			time.AfterFunc(delay, func() { c.Drive(n, 0) })
+		}
+	})
+}
+
+func TestProximity(t *testing.T) {
+	c := sim.NewChip(1)
+	pin, err := c.Pin(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pin.Close()
+	discharge(c, 0, 2*time.Millisecond)
+	p := sensor.NewProximity(pin)
+	for i := 0; i < 3; i++ {
+		us, err := p.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if us < 2000 || us > p.Max {
+			t.Errorf("Read: got %dus, want about 2000us", us)
+		}
+	}
+}
+
+func TestProximityRange(t *testing.T) {
+	c := sim.NewChip(1)
+	pin, err := c.Pin(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pin.Close()
+	discharge(c, 0, 2*time.Millisecond)
+	p := sensor.NewProximity(pin)
+	// Readings out of range are retried.
+	p.Max = 1000
+	if _, err := p.Read(); !errors.Is(err, io.ErrRetriesExceeded) {
+		t.Errorf("out of range: got %v, want ErrRetriesExceeded", err)
+	}
+}
+
+func TestProximityTimeout(t *testing.T) {
+	c := sim.NewChip(1)
+	pin, err := c.Pin(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pin.Close()
+	p := sensor.NewProximity(pin)
+	// The capacitor never discharges.
+	if _, err := p.Read(); !errors.Is(err, io.ErrTimeout) {
+		t.Errorf("no discharge: got %v, want ErrTimeout", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(5*time.Millisecond, cancel)
+	if _, err := p.ReadContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled: got %v, want context.Canceled", err)
+	}
+}
+
+// timeoutPin records how the pin is waited upon.
+type timeoutPin struct {
+	*sim.Pin
+	timeouts, contexts int
+}
+
+func (p *timeoutPin) GetTimeout(tout time.Duration) (int, error) {
+	p.timeouts++
+	return p.Pin.GetTimeout(tout)
+}
+
+func (p *timeoutPin) GetContext(ctx context.Context) (int, error) {
+	p.contexts++
+	return p.Pin.GetContext(ctx)
+}
+
+func TestProximityWait(t *testing.T) {
+	c := sim.NewChip(1)
+	pin, err := c.Pin(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pin.Close()
+	discharge(c, 0, 2*time.Millisecond)
+	tp := &timeoutPin{Pin: pin}
+	p := sensor.NewProximity(tp)
+	// Without a context, no per-wait context is needed.
+	if _, err := p.Read(); err != nil {
+		t.Fatal(err)
+	}
+	if tp.timeouts == 0 || tp.contexts != 0 {
+		t.Errorf("Read: %d GetTimeout and %d GetContext calls", tp.timeouts, tp.contexts)
+	}
+	tp.timeouts = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := p.ReadContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if tp.timeouts != 0 || tp.contexts == 0 {
+		t.Errorf("ReadContext: %d GetTimeout and %d GetContext calls", tp.timeouts, tp.contexts)
+	}
+}
@@ -0,0 +1,547 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sim provides an in-memory simulated GPIO chip, so that code
+// using the io interfaces can be exercised without hardware.
+//
+// The pins of the chip can be wired together so that an output drives
+// the inputs it is connected to, driven directly from test code to emulate
+// an external signal, and observed to check the outputs.
+package sim
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aamcrae/gpio"
+	"golang.org/x/sys/unix"
+)
+
+// Change records a change of level or direction on a pin.
+type Change struct {
+	Time      time.Time
+	Direction int
+	Level     int
+}
+
+// net is a set of pins wired together, which all share the same level.
+type net struct {
+	level int
+	pins  []*Pin
+}
+
+// Chip is a simulated GPIO chip.
+type Chip struct {
+	mu        sync.Mutex
+	pins      []*Pin           // Current handle of each pin
+	observers [][]func(Change) // Observers of each pin
+	epoch     time.Time        // Reference for event timestamps
+}
+
+// Pin is one pin of a simulated chip. It implements io.GpioPin.
+type Pin struct {
+	chip      *Chip
+	number    int
+	net       *net
+	direction int
+	edge      int
+	open      bool
+	closed    bool
+	edgeCh    chan struct{} // Signalled when a detected edge is pending
+	closeCh   chan struct{} // Closed when the pin is closed
+	wfd       int           // eventfd signalled for a Watcher, or -1
+	wevs      []io.Event    // Events pending for a Watcher
+	seq       uint64        // Sequence number of events
+}
+
+// Lines is a group of pins of a simulated chip that are set and read
+// together. Bit n of the values corresponds to pin n of the group.
+type Lines struct {
+	chip *Chip
+	pins []*Pin
+}
+
+var _ io.GpioPin = (*Pin)(nil)
+var _ io.ContextGetter = (*Pin)(nil)
+var _ io.EdgeGetter = (*Pin)(nil)
+var _ io.Watchable = (*Pin)(nil)
+var _ io.ValuesSetter = (*Lines)(nil)
+
+// NewChip creates a simulated chip with the number of pins requested.
+// Each pin is initially an unconnected input with a level of 0.
+func NewChip(n int) *Chip {
+	c := &Chip{pins: make([]*Pin, n), observers: make([][]func(Change), n), epoch: time.Now()}
+	for i := range c.pins {
+		c.pins[i] = c.newPin(i, &net{})
+	}
+	return c
+}
+
+// Pin opens a pin as an input. A pin that is already open returns
+// io.ErrBusy. Each open returns a new handle, so that a handle that
+// has been closed does not affect a later open of the pin.
+func (c *Chip) Pin(n int) (*Pin, error) {
+	if err := c.check(n); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	p := c.pins[n]
+	if p.open {
+		c.mu.Unlock()
+		return nil, p.error("open", io.ErrBusy)
+	}
+	if p.closed {
+		// Replace the closed handle in its net.
+		np := c.newPin(n, p.net)
+		for i, q := range p.net.pins {
+			if q == p {
+				p.net.pins = append(p.net.pins[:i], p.net.pins[i+1:]...)
+				break
+			}
+		}
+		p = np
+	}
+	p.open = true
+	c.mu.Unlock()
+	if err := p.Direction(io.IN); err != nil {
+		return nil, err
+	}
+	return p, p.Edge(io.NONE)
+}
+
+// OutputPin opens a pin and sets the direction as OUTPUT.
+func (c *Chip) OutputPin(n int) (*Pin, error) {
+	p, err := c.Pin(n)
+	if err != nil {
+		return nil, err
+	}
+	return p, p.Direction(io.OUT)
+}
+
+// Wire connects two pins together. The level of the combined net is
+// the level of the first pin.
+func (c *Chip) Wire(a, b int) error {
+	if err := c.check(a); err != nil {
+		return err
+	}
+	if err := c.check(b); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	pa, pb := c.pins[a], c.pins[b]
+	if pa.net == pb.net {
+		c.mu.Unlock()
+		return nil
+	}
+	old := pb.net
+	for _, p := range old.pins {
+		p.net = pa.net
+	}
+	pa.net.pins = append(pa.net.pins, old.pins...)
+	notify := func() {}
+	if old.level != pa.net.level {
+		notify = c.signal(old.pins, pa.net.level)
+	}
+	c.mu.Unlock()
+	notify()
+	return nil
+}
+
+// Drive sets the level of a pin (and all the pins wired to it),
+// emulating an external signal.
+func (c *Chip) Drive(n, v int) error {
+	if err := c.check(n); err != nil {
+		return err
+	}
+	if v != 0 && v != 1 {
+		return &io.PinError{Pin: fmt.Sprintf("sim%d", n), Op: "drive", Err: os.ErrInvalid}
+	}
+	c.mu.Lock()
+	notify := c.setLevel(c.pins[n].net, v)
+	c.mu.Unlock()
+	notify()
+	return nil
+}
+
+// Level returns the current level of a pin.
+func (c *Chip) Level(n int) int {
+	if c.check(n) != nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pins[n].net.level
+}
+
+// Observe registers a function that is called whenever the level
+// or direction of the pin changes. The function is called without
+// any locks held, and so may drive the chip.
+func (c *Chip) Observe(n int, f func(Change)) error {
+	if err := c.check(n); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.observers[n] = append(c.observers[n], f)
+	c.mu.Unlock()
+	return nil
+}
+
+// Direction sets the mode (direction) of the pin.
+// An output initially drives a level of 0. Edge detection is
+// only active when the pin is an input.
+func (p *Pin) Direction(d int) error {
+	if d != io.IN && d != io.OUT {
+		return p.error("direction", os.ErrInvalid)
+	}
+	c := p.chip
+	c.mu.Lock()
+	if p.closed {
+		c.mu.Unlock()
+		return p.error("direction", os.ErrClosed)
+	}
+	p.direction = d
+	var notify func()
+	if d == io.OUT {
+		notify = c.setLevel(p.net, 0)
+	} else {
+		notify = c.changed([]*Pin{p})
+	}
+	c.mu.Unlock()
+	notify()
+	return nil
+}
+
+// Edge sets the edge detection on the pin.
+// Any pending edge is discarded.
+func (p *Pin) Edge(e int) error {
+	if e < io.NONE || e > io.BOTH {
+		return p.error("edge", os.ErrInvalid)
+	}
+	c := p.chip
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p.closed {
+		return p.error("edge", os.ErrClosed)
+	}
+	if p.direction != io.IN {
+		return p.error("edge", io.ErrNotInput)
+	}
+	p.edge = e
+	select {
+	case <-p.edgeCh:
+	default:
+	}
+	return nil
+}
+
+// GetEdge returns the edge detection setting of the pin.
+func (p *Pin) GetEdge() int {
+	c := p.chip
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return p.edge
+}
+
+// Set the output of the pin (only valid for OUTPUT pins)
+func (p *Pin) Set(v int) error {
+	if v != 0 && v != 1 {
+		return p.error("set", os.ErrInvalid)
+	}
+	c := p.chip
+	c.mu.Lock()
+	if p.closed {
+		c.mu.Unlock()
+		return p.error("set", os.ErrClosed)
+	}
+	if p.direction != io.OUT {
+		c.mu.Unlock()
+		return p.error("set", io.ErrNotOutput)
+	}
+	notify := c.setLevel(p.net, v)
+	c.mu.Unlock()
+	notify()
+	return nil
+}
+
+// Get returns the current value of the pin.
+func (p *Pin) Get() (int, error) {
+	return p.GetTimeout(0)
+}
+
+// GetTimeout returns the value of the pin. As with io.Gpio, if edge
+// detection is enabled the call waits for an edge (that has occurred
+// since the last call) before returning the value.
+// A timeout of 0 is interpreted as no timeout.
+func (p *Pin) GetTimeout(tout time.Duration) (int, error) {
+	return p.getContext(context.Background(), tout)
+}
+
+// GetContext returns the value of the pin, waiting for an edge if edge
+// detection is enabled, until the context is done.
+func (p *Pin) GetContext(ctx context.Context) (int, error) {
+	return p.getContext(ctx, 0)
+}
+
+func (p *Pin) getContext(ctx context.Context, tout time.Duration) (int, error) {
+	c := p.chip
+	c.mu.Lock()
+	if p.closed {
+		c.mu.Unlock()
+		return 0, p.error("get", os.ErrClosed)
+	}
+	edge := p.edge
+	if p.direction != io.IN {
+		edge = io.NONE
+	}
+	closeCh := p.closeCh
+	c.mu.Unlock()
+	if edge != io.NONE {
+		var tc <-chan time.Time
+		if tout != 0 {
+			t := time.NewTimer(tout)
+			defer t.Stop()
+			tc = t.C
+		}
+		select {
+		case <-p.edgeCh:
+		case <-tc:
+			return 0, p.error("get", os.ErrDeadlineExceeded)
+		case <-ctx.Done():
+			return 0, p.error("get", ctx.Err())
+		case <-closeCh:
+			return 0, p.error("get", os.ErrClosed)
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return p.net.level, nil
+}
+
+// Close closes the pin, and a call waiting for an edge returns
+// os.ErrClosed. An output stops driving its net, which returns to a
+// level of 0 unless another output on the net is driving it.
+func (p *Pin) Close() {
+	c := p.chip
+	c.mu.Lock()
+	if p.closed {
+		c.mu.Unlock()
+		return
+	}
+	close(p.closeCh)
+	if p.wfd >= 0 {
+		unix.Close(p.wfd)
+		p.wfd = -1
+	}
+	p.open = false
+	p.closed = true
+	driving := p.direction == io.OUT
+	p.direction = io.IN
+	p.edge = io.NONE
+	notify := func() {}
+	if driving {
+		for _, q := range p.net.pins {
+			if q.direction == io.OUT {
+				driving = false
+			}
+		}
+		if driving {
+			notify = c.setLevel(p.net, 0)
+		}
+	}
+	c.mu.Unlock()
+	notify()
+}
+
+// WatchFd returns an eventfd that is signalled when an edge is detected,
+// so that the pin can be registered with an io.Watcher.
+func (p *Pin) WatchFd() (int, uint32, error) {
+	c := p.chip
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p.closed {
+		return 0, 0, p.error("watch", os.ErrClosed)
+	}
+	if p.edge == io.NONE {
+		return 0, 0, p.error("watch", io.ErrNoEdge)
+	}
+	if p.wfd < 0 {
+		fd, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+		if err != nil {
+			return 0, 0, p.error("watch", err)
+		}
+		p.wfd = fd
+	}
+	p.wevs = nil
+	return p.wfd, unix.EPOLLIN, nil
+}
+
+// WatchEvents returns the edge events detected since the last call.
+// The event timestamps are relative to the creation of the chip.
+func (p *Pin) WatchEvents() ([]io.Event, error) {
+	c := p.chip
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p.wfd < 0 {
+		return nil, p.error("watch", os.ErrClosed)
+	}
+	var b [8]byte
+	unix.Read(p.wfd, b[:])
+	evs := p.wevs
+	p.wevs = nil
+	return evs, nil
+}
+
+// Lines opens a group of pins with the direction selected.
+func (c *Chip) Lines(dir int, pins ...int) (*Lines, error) {
+	if dir != io.IN && dir != io.OUT {
+		return nil, &io.PinError{Pin: "sim", Op: "lines", Err: os.ErrInvalid}
+	}
+	l := &Lines{chip: c}
+	for _, n := range pins {
+		p, err := c.Pin(n)
+		if err == nil {
+			err = p.Direction(dir)
+		}
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		l.pins = append(l.pins, p)
+	}
+	return l, nil
+}
+
+// SetValues sets the outputs of the group in a single operation, so
+// that no intermediate states are observed.
+func (l *Lines) SetValues(v uint64) error {
+	c := l.chip
+	c.mu.Lock()
+	// Check all the pins before any are changed.
+	for _, p := range l.pins {
+		if p.closed || p.direction != io.OUT {
+			c.mu.Unlock()
+			return p.error("set", io.ErrNotOutput)
+		}
+	}
+	var notify []func()
+	for i, p := range l.pins {
+		notify = append(notify, c.setLevel(p.net, int(v>>uint(i))&1))
+	}
+	c.mu.Unlock()
+	for _, f := range notify {
+		f()
+	}
+	return nil
+}
+
+// GetValues returns the current values of the group.
+func (l *Lines) GetValues() (uint64, error) {
+	c := l.chip
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var v uint64
+	for i, p := range l.pins {
+		v |= uint64(p.net.level) << uint(i)
+	}
+	return v, nil
+}
+
+// Close closes the pins of the group.
+func (l *Lines) Close() {
+	for _, p := range l.pins {
+		p.Close()
+	}
+}
+
+// check checks that the pin number is valid.
+func (c *Chip) check(n int) error {
+	if n < 0 || n >= len(c.pins) {
+		return &io.PinError{Pin: fmt.Sprintf("sim%d", n), Op: "pin", Err: os.ErrInvalid}
+	}
+	return nil
+}
+
+// newPin creates a new handle for a pin on a net, and makes it the
+// current handle of the pin. The chip lock must be held if the chip
+// is in use.
+func (c *Chip) newPin(n int, nt *net) *Pin {
+	p := &Pin{chip: c, number: n, net: nt, edgeCh: make(chan struct{}, 1), closeCh: make(chan struct{}), wfd: -1}
+	nt.pins = append(nt.pins, p)
+	c.pins[n] = p
+	return p
+}
+
+// error returns a PinError for an operation on the pin.
+func (p *Pin) error(op string, err error) error {
+	return &io.PinError{Pin: fmt.Sprintf("sim%d", p.number), Op: op, Err: err}
+}
+
+// setLevel sets the level of a net, and signals any pins that are waiting
+// for the edge. The chip lock must be held, and a function is returned that
+// calls the observers, which must be called after the lock is released.
+func (c *Chip) setLevel(n *net, v int) func() {
+	if n.level == v {
+		return func() {}
+	}
+	n.level = v
+	return c.signal(n.pins, v)
+}
+
+// signal signals the pins that have changed to the new level.
+// The chip lock must be held.
+func (c *Chip) signal(pins []*Pin, v int) func() {
+	for _, p := range pins {
+		if p.closed || p.direction != io.IN {
+			continue
+		}
+		if p.edge == io.BOTH || (p.edge == io.RISING && v == 1) || (p.edge == io.FALLING && v == 0) {
+			select {
+			case p.edgeCh <- struct{}{}:
+			default:
+			}
+			if p.wfd >= 0 {
+				p.seq++
+				e := io.Event{Edge: io.FALLING, Level: v, Time: time.Since(c.epoch), Seq: p.seq}
+				if v == 1 {
+					e.Edge = io.RISING
+				}
+				p.wevs = append(p.wevs, e)
+				unix.Write(p.wfd, []byte{1, 0, 0, 0, 0, 0, 0, 0})
+			}
+		}
+	}
+	return c.changed(pins)
+}
+
+// changed returns a function that calls the observers of the pins.
+// The chip lock must be held.
+func (c *Chip) changed(pins []*Pin) func() {
+	var calls []func()
+	now := time.Now()
+	for _, p := range pins {
+		ch := Change{Time: now, Direction: p.direction, Level: p.net.level}
+		for _, f := range c.observers[p.number] {
+			f := f
+			calls = append(calls, func() { f(ch) })
+		}
+	}
+	return func() {
+		for _, f := range calls {
+			f()
+		}
+	}
+}
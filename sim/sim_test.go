@@ -0,0 +1,186 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sim
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aamcrae/gpio"
+)
+
+func TestEdge(t *testing.T) {
+	c := NewChip(2)
+	out, err := c.OutputPin(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := c.Pin(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Wire(0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := in.Edge(io.FALLING); err != nil {
+		t.Fatal(err)
+	}
+	out.Set(1)
+	if _, err := in.GetTimeout(10 * time.Millisecond); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("rising edge: got %v, want ErrDeadlineExceeded", err)
+	}
+	out.Set(0)
+	if v, err := in.GetTimeout(10 * time.Millisecond); err != nil || v != 0 {
+		t.Errorf("falling edge: got %d, %v", v, err)
+	}
+}
+
+func TestCloseWakes(t *testing.T) {
+	c := NewChip(1)
+	p, err := c.Pin(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Edge(io.BOTH); err != nil {
+		t.Fatal(err)
+	}
+	werr := make(chan error)
+	go func() {
+		_, err := p.GetTimeout(0)
+		werr <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	p.Close()
+	select {
+	case err := <-werr:
+		var pe *io.PinError
+		if !errors.Is(err, os.ErrClosed) || !errors.As(err, &pe) || pe.Pin != "sim0" {
+			t.Errorf("GetTimeout: got %v, want PinError for sim0 matching ErrClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("GetTimeout not woken by Close")
+	}
+	for op, err := range map[string]error{
+		"Set":       p.Set(1),
+		"Direction": p.Direction(io.OUT),
+		"Edge":      p.Edge(io.NONE),
+	} {
+		var pe *io.PinError
+		if !errors.Is(err, os.ErrClosed) || !errors.As(err, &pe) {
+			t.Errorf("%s after Close: got %v, want PinError matching ErrClosed", op, err)
+		}
+	}
+	if _, _, err := p.WatchFd(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("WatchFd after Close: got %v, want ErrClosed", err)
+	}
+	// The pin can be opened again.
+	p, err = c.Pin(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := p.GetTimeout(0); err != nil || v != 0 {
+		t.Errorf("reopened: got %d, %v", v, err)
+	}
+}
+
+func TestSetValues(t *testing.T) {
+	c := NewChip(3)
+	l, err := c.Lines(io.OUT, 0, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if _, err := c.Lines(2, 0); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("Lines(2): got %v, want ErrInvalid", err)
+	}
+	var changes int
+	for i := 0; i < 3; i++ {
+		c.Observe(i, func(Change) { changes++ })
+	}
+	if err := l.SetValues(5); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := l.GetValues(); err != nil || v != 5 || changes != 2 {
+		t.Errorf("SetValues(5): got %d, %v, %d changes", v, err, changes)
+	}
+	// A failure leaves all the pins unchanged.
+	l.pins[2].Direction(io.IN)
+	changes = 0
+	if err := l.SetValues(2); !errors.Is(err, io.ErrNotOutput) {
+		t.Errorf("SetValues with an input: got %v, want ErrNotOutput", err)
+	}
+	if c.Level(0) != 1 || c.Level(1) != 0 || changes != 0 {
+		t.Errorf("pins changed by failed SetValues: %d %d, %d changes", c.Level(0), c.Level(1), changes)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	c := NewChip(1)
+	p, err := c.Pin(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Pin(0); !errors.Is(err, io.ErrBusy) {
+		t.Errorf("open while open: got %v, want ErrBusy", err)
+	}
+	p.Close()
+	p2, err := c.Pin(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p2.Close()
+	if p2 == p {
+		t.Error("reopen returned the closed handle")
+	}
+	// Closing the old handle again does not close the new one.
+	p.Close()
+	if err := p2.Direction(io.OUT); err != nil {
+		t.Errorf("Direction after old handle closed: %v", err)
+	}
+	if err := p2.Set(1); err != nil || c.Level(0) != 1 {
+		t.Errorf("Set after old handle closed: got %v, level %d", err, c.Level(0))
+	}
+}
+
+func TestCloseDriver(t *testing.T) {
+	c := NewChip(3)
+	c.Wire(0, 1)
+	c.Wire(0, 2)
+	var levels []int
+	c.Observe(2, func(ch Change) { levels = append(levels, ch.Level) })
+	a, err := c.OutputPin(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := c.OutputPin(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Set(1)
+	// The net is still driven by the other output.
+	a.Close()
+	if c.Level(2) != 1 {
+		t.Errorf("level with an output remaining: got %d, want 1", c.Level(2))
+	}
+	b.Close()
+	if c.Level(2) != 0 {
+		t.Errorf("level after the outputs closed: got %d, want 0", c.Level(2))
+	}
+	if len(levels) != 2 || levels[0] != 1 || levels[1] != 0 {
+		t.Errorf("observed levels: got %v, want [1 0]", levels)
+	}
+}
@@ -0,0 +1,370 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// SMBus commands on an I2C bus.
+// If the adapter supports the SMBus command natively, the I2C_SMBUS ioctl
+// is used, otherwise the command is emulated using I2C messages.
+
+package io
+
+import (
+	"errors"
+	"os"
+	"unsafe"
+)
+
+const SmbusBlockMax = 32 // Maximum length of a SMBus block transfer
+
+// Adapter functionality bits
+const (
+	i2cFuncI2c                = 0x00000001
+	i2cFuncTenBitAddr         = 0x00000002
+	i2cFuncSmbusPec           = 0x00000008
+	i2cFuncSmbusBlockProcCall = 0x00008000
+	i2cFuncSmbusQuick         = 0x00010000
+	i2cFuncSmbusReadByte      = 0x00020000
+	i2cFuncSmbusWriteByte     = 0x00040000
+	i2cFuncSmbusReadByteData  = 0x00080000
+	i2cFuncSmbusWriteByteData = 0x00100000
+	i2cFuncSmbusReadWordData  = 0x00200000
+	i2cFuncSmbusWriteWordData = 0x00400000
+	i2cFuncSmbusProcCall      = 0x00800000
+	i2cFuncSmbusReadBlock     = 0x01000000
+	i2cFuncSmbusWriteBlock    = 0x02000000
+)
+
+// SMBus transaction sizes
+const (
+	smbusQuick         = 0
+	smbusByte          = 1
+	smbusByteData      = 2
+	smbusWordData      = 3
+	smbusProcCall      = 4
+	smbusBlockData     = 5
+	smbusBlockProcCall = 7
+)
+
+// SMBus read/write
+const (
+	smbusWrite = 0
+	smbusRead  = 1
+)
+
+type i2c_smbus_ioctl_data struct {
+	read_write byte
+	command    byte
+	_          [2]byte
+	size       uint32
+	data       unsafe.Pointer // Pointer, so that the data is not moved while in use
+}
+
+// i2c_smbus_data is the union of the byte, word and block data.
+// For blocks, the first byte is the length.
+type i2c_smbus_data [SmbusBlockMax + 2]byte
+
+// PEC enables or disables packet error checking on SMBus commands.
+// The setting is applied by the adapter on each command, so device
+// handles on the same bus may use different settings.
+func (i2 *I2C) PEC(enable bool) error {
+	if i2.funcs&(i2cFuncSmbusPec|i2cFuncI2c) == 0 {
+		return busError(i2.name(), -1, "pec", ErrNotSupported)
+	}
+	i2.pec = enable
+	return nil
+}
+
+// QuickCommand sends the SMBus quick command, where the read/write bit
+// (1 for read) is the only data sent.
+func (i2 *I2C) QuickCommand(rw byte) error {
+	if i2.funcs&i2cFuncSmbusQuick != 0 {
+		return i2.smbus("quick", rw&1, 0, smbusQuick, nil)
+	}
+	m := []I2cMsg{{Addr: i2.addr}}
+	if rw&1 != 0 {
+		m[0].Flags = I2cFlagRead
+	}
+	return i2.emulate("quick", i2cFuncI2c, m)
+}
+
+// ReadByte reads a byte from the device without a command byte.
+func (i2 *I2C) ReadByte() (byte, error) {
+	if i2.funcs&i2cFuncSmbusReadByte != 0 {
+		var d i2c_smbus_data
+		err := i2.smbus("read byte", smbusRead, 0, smbusByte, &d)
+		return d[0], err
+	}
+	b, err := i2.emulateRead("read byte", nil, 1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// WriteByte writes a byte to the device without a command byte.
+func (i2 *I2C) WriteByte(v byte) error {
+	if i2.funcs&i2cFuncSmbusWriteByte != 0 {
+		return i2.smbus("write byte", smbusWrite, v, smbusByte, nil)
+	}
+	return i2.emulateWrite("write byte", []byte{v})
+}
+
+// ReadByteData reads a byte from the register selected by the command.
+func (i2 *I2C) ReadByteData(cmd byte) (byte, error) {
+	if i2.funcs&i2cFuncSmbusReadByteData != 0 {
+		var d i2c_smbus_data
+		err := i2.smbus("read byte data", smbusRead, cmd, smbusByteData, &d)
+		return d[0], err
+	}
+	b, err := i2.emulateRead("read byte data", []byte{cmd}, 1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// WriteByteData writes a byte to the register selected by the command.
+func (i2 *I2C) WriteByteData(cmd, v byte) error {
+	if i2.funcs&i2cFuncSmbusWriteByteData != 0 {
+		d := i2c_smbus_data{v}
+		return i2.smbus("write byte data", smbusWrite, cmd, smbusByteData, &d)
+	}
+	return i2.emulateWrite("write byte data", []byte{cmd, v})
+}
+
+// ReadWordData reads a 16 bit (little endian) word from the register
+// selected by the command.
+func (i2 *I2C) ReadWordData(cmd byte) (uint16, error) {
+	if i2.funcs&i2cFuncSmbusReadWordData != 0 {
+		var d i2c_smbus_data
+		err := i2.smbus("read word data", smbusRead, cmd, smbusWordData, &d)
+		return uint16(d[0]) | uint16(d[1])<<8, err
+	}
+	b, err := i2.emulateRead("read word data", []byte{cmd}, 2)
+	if err != nil {
+		return 0, err
+	}
+	return uint16(b[0]) | uint16(b[1])<<8, nil
+}
+
+// WriteWordData writes a 16 bit (little endian) word to the register
+// selected by the command.
+func (i2 *I2C) WriteWordData(cmd byte, v uint16) error {
+	if i2.funcs&i2cFuncSmbusWriteWordData != 0 {
+		d := i2c_smbus_data{byte(v), byte(v >> 8)}
+		return i2.smbus("write word data", smbusWrite, cmd, smbusWordData, &d)
+	}
+	return i2.emulateWrite("write word data", []byte{cmd, byte(v), byte(v >> 8)})
+}
+
+// ProcessCall writes a 16 bit word to the register selected by the
+// command, and reads a 16 bit word in response.
+func (i2 *I2C) ProcessCall(cmd byte, v uint16) (uint16, error) {
+	if i2.funcs&i2cFuncSmbusProcCall != 0 {
+		d := i2c_smbus_data{byte(v), byte(v >> 8)}
+		err := i2.smbus("process call", smbusWrite, cmd, smbusProcCall, &d)
+		return uint16(d[0]) | uint16(d[1])<<8, err
+	}
+	b, err := i2.emulateRead("process call", []byte{cmd, byte(v), byte(v >> 8)}, 2)
+	if err != nil {
+		return 0, err
+	}
+	return uint16(b[0]) | uint16(b[1])<<8, nil
+}
+
+// ReadBlockData reads a block of up to SmbusBlockMax bytes from the
+// register selected by the command. The length is sent by the device.
+func (i2 *I2C) ReadBlockData(cmd byte) ([]byte, error) {
+	if i2.funcs&i2cFuncSmbusReadBlock != 0 {
+		var d i2c_smbus_data
+		err := i2.smbus("read block data", smbusRead, cmd, smbusBlockData, &d)
+		if err != nil {
+			return nil, err
+		}
+		return blockData(&d), nil
+	}
+	return i2.emulateReadBlock("read block data", []byte{cmd})
+}
+
+// WriteBlockData writes a block of up to SmbusBlockMax bytes to the
+// register selected by the command.
+func (i2 *I2C) WriteBlockData(cmd byte, b []byte) error {
+	if len(b) == 0 || len(b) > SmbusBlockMax {
+		return busError(i2.name(), int(i2.addr), "write block data", os.ErrInvalid)
+	}
+	if i2.funcs&i2cFuncSmbusWriteBlock != 0 {
+		var d i2c_smbus_data
+		d[0] = byte(len(b))
+		copy(d[1:], b)
+		return i2.smbus("write block data", smbusWrite, cmd, smbusBlockData, &d)
+	}
+	return i2.emulateWrite("write block data", append([]byte{cmd, byte(len(b))}, b...))
+}
+
+// BlockProcessCall writes a block to the register selected by the command,
+// and reads a block in response.
+func (i2 *I2C) BlockProcessCall(cmd byte, b []byte) ([]byte, error) {
+	if len(b) == 0 || len(b) > SmbusBlockMax {
+		return nil, busError(i2.name(), int(i2.addr), "block process call", os.ErrInvalid)
+	}
+	if i2.funcs&i2cFuncSmbusBlockProcCall != 0 {
+		var d i2c_smbus_data
+		d[0] = byte(len(b))
+		copy(d[1:], b)
+		err := i2.smbus("block process call", smbusWrite, cmd, smbusBlockProcCall, &d)
+		if err != nil {
+			return nil, err
+		}
+		return blockData(&d), nil
+	}
+	return i2.emulateReadBlock("block process call", append([]byte{cmd, byte(len(b))}, b...))
+}
+
+// smbus performs a SMBus command using the I2C_SMBUS ioctl.
+func (i2 *I2C) smbus(op string, rw, cmd byte, size uint32, d *i2c_smbus_data) error {
+	return i2.smbusAddr(i2.addr, op, rw, cmd, size, d)
+}
+
+// smbusAddr performs a SMBus command to the address selected.
+func (i2 *I2C) smbusAddr(addr uint16, op string, rw, cmd byte, size uint32, d *i2c_smbus_data) error {
+	args := i2c_smbus_ioctl_data{read_write: rw, command: cmd, size: size}
+	if d != nil {
+		args.data = unsafe.Pointer(d)
+	}
+	i2.adapter.lock()
+	err := i2.adapter.smbus(addr, i2.pec, &args)
+	i2.adapter.unlock()
+	return busError(i2.name(), int(addr), op, err)
+}
+
+// emulate sends the messages if the adapter supports the functions required.
+func (i2 *I2C) emulate(op string, funcs uint32, m []I2cMsg) error {
+	if i2.funcs&funcs != funcs {
+		return busError(i2.name(), int(i2.addr), op, ErrNotSupported)
+	}
+	err := i2.Message(m)
+	var be *BusError
+	if errors.As(err, &be) {
+		be.Op = op
+	}
+	return err
+}
+
+// emulateWrite writes the data, followed by the PEC if enabled.
+func (i2 *I2C) emulateWrite(op string, w []byte) error {
+	if i2.pec {
+		w = append(w, pec(i2.addr<<1, w))
+	}
+	return i2.emulate(op, i2cFuncI2c, []I2cMsg{{Addr: i2.addr, Buf: w}})
+}
+
+// emulateRead optionally writes the data, and then reads n bytes, checking
+// the PEC if enabled.
+func (i2 *I2C) emulateRead(op string, w []byte, n int) ([]byte, error) {
+	r := make([]byte, n)
+	if i2.pec {
+		r = append(r, 0)
+	}
+	var m []I2cMsg
+	if len(w) != 0 {
+		m = append(m, I2cMsg{Addr: i2.addr, Buf: w})
+	}
+	m = append(m, I2cMsg{Addr: i2.addr, Flags: I2cFlagRead, Buf: r})
+	if err := i2.emulate(op, i2cFuncI2c, m); err != nil {
+		return nil, err
+	}
+	if err := i2.checkPec(op, w, r); err != nil {
+		return nil, err
+	}
+	return r[:n], nil
+}
+
+// emulateReadBlock writes the data, and then reads a block where the
+// first byte received is the length of the block.
+func (i2 *I2C) emulateReadBlock(op string, w []byte) ([]byte, error) {
+	// The kernel requires the buffer to be large enough for the maximum
+	// block, with the first byte set to the number of bytes to be read
+	// in addition to the block itself.
+	r := make([]byte, SmbusBlockMax+2)
+	r[0] = 1
+	if i2.pec {
+		r[0] = 2
+	}
+	m := []I2cMsg{
+		{Addr: i2.addr, Buf: w},
+		{Addr: i2.addr, Flags: I2cFlagRead | I2cFlagRecvLen, Buf: r},
+	}
+	if err := i2.emulate(op, i2cFuncI2c, m); err != nil {
+		return nil, err
+	}
+	n := int(r[0])
+	if n == 0 || n > SmbusBlockMax {
+		return nil, busError(i2.name(), int(i2.addr), op, os.ErrInvalid)
+	}
+	end := n + 1
+	if i2.pec {
+		end++
+	}
+	if err := i2.checkPec(op, w, r[:end]); err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), r[1:n+1]...), nil
+}
+
+// checkPec verifies the PEC that is the last byte of the response.
+func (i2 *I2C) checkPec(op string, w, r []byte) error {
+	if !i2.pec {
+		return nil
+	}
+	var b []byte
+	if len(w) != 0 {
+		b = append(b, byte(i2.addr<<1))
+		b = append(b, w...)
+	}
+	b = append(b, byte(i2.addr<<1)|1)
+	b = append(b, r[:len(r)-1]...)
+	if crc8(b) != r[len(r)-1] {
+		return busError(i2.name(), int(i2.addr), op, ErrPec)
+	}
+	return nil
+}
+
+// blockData returns a copy of the block from the SMBus data.
+func blockData(d *i2c_smbus_data) []byte {
+	n := int(d[0])
+	if n > SmbusBlockMax {
+		n = SmbusBlockMax
+	}
+	return append([]byte(nil), d[1:n+1]...)
+}
+
+// pec returns the PEC of a write to the address.
+func pec(addr uint16, w []byte) byte {
+	return crc8(append([]byte{byte(addr)}, w...))
+}
+
+// crc8 calculates the SMBus CRC-8 (polynomial x^8 + x^2 + x + 1).
+func crc8(b []byte) byte {
+	var crc byte
+	for _, v := range b {
+		crc ^= v
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,299 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package io
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+const smbusAll = i2cFuncSmbusPec | i2cFuncSmbusBlockProcCall | i2cFuncSmbusQuick |
+	i2cFuncSmbusReadByte | i2cFuncSmbusWriteByte | i2cFuncSmbusReadByteData |
+	i2cFuncSmbusWriteByteData | i2cFuncSmbusReadWordData | i2cFuncSmbusWriteWordData |
+	i2cFuncSmbusProcCall | i2cFuncSmbusReadBlock | i2cFuncSmbusWriteBlock
+
+// fakeI2c is an I2C adapter that records the transactions, and
+// returns the reply data for reads.
+type fakeI2c struct {
+	mu      sync.Mutex
+	present map[uint16]bool // Addresses that acknowledge, all if nil
+	busy    map[uint16]bool // Addresses in use by a kernel driver
+	xfers   [][]I2cMsg      // Copies of the transfers
+	cmds    []fakeSmbus     // SMBus commands
+	reply   []byte          // Data for reads
+	yield   bool            // Yield the processor in each transfer
+}
+
+// fakeSmbus records a SMBus command.
+type fakeSmbus struct {
+	addr    uint16
+	pec     bool
+	rw, cmd byte
+	size    uint32
+	data    i2c_smbus_data
+}
+
+// newFakeI2c creates a bus using a fake adapter with the functionality.
+func newFakeI2c(funcs uint32) (*I2C, *fakeI2c) {
+	f := new(fakeI2c)
+	return &I2C{bus: 1, adapter: f, funcs: funcs, addr: 0x48}, f
+}
+
+// ack returns the error for a transaction to the address.
+func (f *fakeI2c) ack(addr uint16) error {
+	if f.busy[addr] {
+		return unix.EBUSY
+	}
+	if f.present != nil && !f.present[addr] {
+		return unix.ENXIO
+	}
+	return nil
+}
+
+func (f *fakeI2c) lock() {
+	f.mu.Lock()
+}
+
+func (f *fakeI2c) unlock() {
+	f.mu.Unlock()
+}
+
+func (f *fakeI2c) transfer(msgs []I2cMsg) error {
+	var x []I2cMsg
+	for _, m := range msgs {
+		m.Buf = append([]byte(nil), m.Buf...)
+		x = append(x, m)
+	}
+	f.xfers = append(f.xfers, x)
+	if f.yield {
+		runtime.Gosched()
+	}
+	if err := f.ack(msgs[0].Addr); err != nil {
+		return err
+	}
+	for _, m := range msgs {
+		if m.Flags&I2cFlagRead != 0 {
+			copy(m.Buf, f.reply)
+		}
+	}
+	return nil
+}
+
+func (f *fakeI2c) smbus(addr uint16, pec bool, args *i2c_smbus_ioctl_data) error {
+	c := fakeSmbus{addr: addr, pec: pec, rw: args.read_write, cmd: args.command, size: args.size}
+	var d *i2c_smbus_data
+	if args.data != nil {
+		d = (*i2c_smbus_data)(args.data)
+		c.data = *d
+	}
+	f.cmds = append(f.cmds, c)
+	if err := f.ack(addr); err != nil {
+		return err
+	}
+	if d != nil && (args.read_write == smbusRead || args.size == smbusProcCall || args.size == smbusBlockProcCall) {
+		copy(d[:], f.reply)
+	}
+	return nil
+}
+
+func (f *fakeI2c) control(req, arg uintptr) error {
+	return nil
+}
+
+func (f *fakeI2c) close() error {
+	return nil
+}
+
+func TestSmbusNative(t *testing.T) {
+	i2, f := newFakeI2c(i2cFuncI2c | smbusAll)
+	f.reply = []byte{0x34, 0x12}
+	if v, err := i2.ReadWordData(0x10); err != nil || v != 0x1234 {
+		t.Errorf("ReadWordData: got 0x%x, %v, want 0x1234", v, err)
+	}
+	if err := i2.WriteWordData(0x11, 0xBEEF); err != nil {
+		t.Fatal(err)
+	}
+	if err := i2.WriteBlockData(0x12, []byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	f.reply = []byte{3, 7, 8, 9}
+	if b, err := i2.ReadBlockData(0x13); err != nil || !bytes.Equal(b, []byte{7, 8, 9}) {
+		t.Errorf("ReadBlockData: got %v, %v, want [7 8 9]", b, err)
+	}
+	if err := i2.PEC(true); err != nil {
+		t.Fatal(err)
+	}
+	f.reply = []byte{0x55}
+	if v, err := i2.ReadByteData(0x14); err != nil || v != 0x55 {
+		t.Errorf("ReadByteData: got 0x%x, %v, want 0x55", v, err)
+	}
+	if len(f.xfers) != 0 {
+		t.Errorf("native commands used %d transfers", len(f.xfers))
+	}
+	want := []struct {
+		rw, cmd byte
+		size    uint32
+		data    []byte
+		pec     bool
+	}{
+		{smbusRead, 0x10, smbusWordData, nil, false},
+		{smbusWrite, 0x11, smbusWordData, []byte{0xEF, 0xBE}, false},
+		{smbusWrite, 0x12, smbusBlockData, []byte{3, 1, 2, 3}, false},
+		{smbusRead, 0x13, smbusBlockData, nil, false},
+		{smbusRead, 0x14, smbusByteData, nil, true},
+	}
+	if len(f.cmds) != len(want) {
+		t.Fatalf("got %d SMBus commands, want %d", len(f.cmds), len(want))
+	}
+	for i, w := range want {
+		c := f.cmds[i]
+		if c.addr != 0x48 || c.rw != w.rw || c.cmd != w.cmd || c.size != w.size || c.pec != w.pec {
+			t.Errorf("command %d: got %+v", i, c)
+		}
+		if w.data != nil && !bytes.Equal(c.data[:len(w.data)], w.data) {
+			t.Errorf("command %d: wrote %v, want %v", i, c.data[:len(w.data)], w.data)
+		}
+	}
+}
+
+func TestSmbusEmulated(t *testing.T) {
+	i2, f := newFakeI2c(i2cFuncI2c)
+	f.reply = []byte{0x34, 0x12}
+	if v, err := i2.ReadWordData(0x10); err != nil || v != 0x1234 {
+		t.Errorf("ReadWordData: got 0x%x, %v, want 0x1234", v, err)
+	}
+	if err := i2.WriteWordData(0x11, 0xBEEF); err != nil {
+		t.Fatal(err)
+	}
+	f.reply = []byte{0x78, 0x56}
+	if v, err := i2.ProcessCall(0x12, 0x1234); err != nil || v != 0x5678 {
+		t.Errorf("ProcessCall: got 0x%x, %v, want 0x5678", v, err)
+	}
+	if len(f.cmds) != 0 {
+		t.Errorf("emulated commands used %d SMBus commands", len(f.cmds))
+	}
+	want := [][]I2cMsg{
+		{{Addr: 0x48, Buf: []byte{0x10}}, {Addr: 0x48, Flags: I2cFlagRead, Buf: []byte{0, 0}}},
+		{{Addr: 0x48, Buf: []byte{0x11, 0xEF, 0xBE}}},
+		{{Addr: 0x48, Buf: []byte{0x12, 0x34, 0x12}}, {Addr: 0x48, Flags: I2cFlagRead, Buf: []byte{0, 0}}},
+	}
+	checkXfers(t, f.xfers, want)
+
+	// Without I2C support, commands that are not native are not supported.
+	i2, _ = newFakeI2c(i2cFuncSmbusReadByteData)
+	if _, err := i2.ReadWordData(0x10); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("ReadWordData without support: got %v, want ErrNotSupported", err)
+	}
+}
+
+func TestSmbusPec(t *testing.T) {
+	i2, f := newFakeI2c(i2cFuncI2c)
+	if err := i2.PEC(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := i2.WriteByteData(0x05, 0xAA); err != nil {
+		t.Fatal(err)
+	}
+	crc := crc8([]byte{0x48 << 1, 0x05, 0x48<<1 | 1, 0x66})
+	f.reply = []byte{0x66, crc}
+	if v, err := i2.ReadByteData(0x05); err != nil || v != 0x66 {
+		t.Errorf("ReadByteData: got 0x%x, %v, want 0x66", v, err)
+	}
+	f.reply = []byte{0x66, crc ^ 1}
+	if _, err := i2.ReadByteData(0x05); !errors.Is(err, ErrPec) {
+		t.Errorf("ReadByteData with a bad PEC: got %v, want ErrPec", err)
+	}
+	want := [][]I2cMsg{
+		{{Addr: 0x48, Buf: []byte{0x05, 0xAA, crc8([]byte{0x48 << 1, 0x05, 0xAA})}}},
+		{{Addr: 0x48, Buf: []byte{0x05}}, {Addr: 0x48, Flags: I2cFlagRead, Buf: []byte{0, 0}}},
+		{{Addr: 0x48, Buf: []byte{0x05}}, {Addr: 0x48, Flags: I2cFlagRead, Buf: []byte{0, 0}}},
+	}
+	checkXfers(t, f.xfers, want)
+}
+
+func TestSmbusBlock(t *testing.T) {
+	i2, f := newFakeI2c(i2cFuncI2c)
+	f.reply = []byte{3, 7, 8, 9}
+	if b, err := i2.ReadBlockData(0x20); err != nil || !bytes.Equal(b, []byte{7, 8, 9}) {
+		t.Errorf("ReadBlockData: got %v, %v, want [7 8 9]", b, err)
+	}
+	// The read buffer holds the maximum block, and the first byte is the
+	// number of bytes to read in addition to the block.
+	r := f.xfers[0][1]
+	if r.Flags != I2cFlagRead|I2cFlagRecvLen || len(r.Buf) != SmbusBlockMax+2 || r.Buf[0] != 1 {
+		t.Errorf("block read message: flags 0x%x len %d count %d", r.Flags, len(r.Buf), r.Buf[0])
+	}
+	for _, n := range []byte{0, SmbusBlockMax + 1} {
+		f.reply = []byte{n}
+		if _, err := i2.ReadBlockData(0x20); !errors.Is(err, os.ErrInvalid) {
+			t.Errorf("ReadBlockData with length %d: got %v, want ErrInvalid", n, err)
+		}
+	}
+	for _, n := range []int{0, SmbusBlockMax + 1} {
+		if err := i2.WriteBlockData(0x20, make([]byte, n)); !errors.Is(err, os.ErrInvalid) {
+			t.Errorf("WriteBlockData of %d bytes: got %v, want ErrInvalid", n, err)
+		}
+	}
+	if err := i2.WriteBlockData(0x21, []byte{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if w := f.xfers[len(f.xfers)-1][0].Buf; !bytes.Equal(w, []byte{0x21, 2, 1, 2}) {
+		t.Errorf("WriteBlockData: wrote %v, want [33 2 1 2]", w)
+	}
+
+	// With PEC, the PEC byte follows the block.
+	if err := i2.PEC(true); err != nil {
+		t.Fatal(err)
+	}
+	crc := crc8([]byte{0x48 << 1, 0x22, 0x48<<1 | 1, 2, 5, 6})
+	f.reply = []byte{2, 5, 6, crc}
+	f.xfers = nil
+	if b, err := i2.ReadBlockData(0x22); err != nil || !bytes.Equal(b, []byte{5, 6}) {
+		t.Errorf("ReadBlockData with PEC: got %v, %v, want [5 6]", b, err)
+	}
+	if r := f.xfers[0][1]; r.Buf[0] != 2 {
+		t.Errorf("block read with PEC: count %d, want 2", r.Buf[0])
+	}
+	f.reply = []byte{2, 5, 6, crc ^ 1}
+	if _, err := i2.ReadBlockData(0x22); !errors.Is(err, ErrPec) {
+		t.Errorf("ReadBlockData with a bad PEC: got %v, want ErrPec", err)
+	}
+}
+
+// checkXfers compares the recorded transfers with those expected.
+func checkXfers(t *testing.T, got, want [][]I2cMsg) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d transfers, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if len(got[i]) != len(want[i]) {
+			t.Errorf("transfer %d: got %d messages, want %d", i, len(got[i]), len(want[i]))
+			continue
+		}
+		for j, w := range want[i] {
+			g := got[i][j]
+			if g.Addr != w.Addr || g.Flags != w.Flags || !bytes.Equal(g.Buf, w.Buf) {
+				t.Errorf("transfer %d message %d: got %+v, want %+v", i, j, g, w)
+			}
+		}
+	}
+}
@@ -15,14 +15,19 @@
 package io
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"time"
 	"unsafe"
 )
 
-var spiDevs = []struct {
-	bus, cs byte
-}{
+// spiDevs are the units of NewSpi, which are the SPI devices
+// of a Raspberry Pi.
+var spiDevs = []SpiDev{
 	{0, 0},
 	{0, 1},
 	{1, 0},
@@ -39,16 +44,19 @@ const (
 
 	SPI_MODE_CS_HIGH   = 0x04
 	SPI_MODE_LSB_FIRST = 0x08
-	// SPI_MODE_3WIRE	   = 0x10	3 wire mode is not supported.
-	SPI_MODE_LOOP  = 0x20
-	SPI_MODE_NO_CS = 0x40
-	SPI_MODE_READY = 0x80
+	SPI_MODE_3WIRE     = 0x10 // Shared data line, transfers must be half duplex
+	SPI_MODE_LOOP      = 0x20
+	SPI_MODE_NO_CS     = 0x40
+	SPI_MODE_READY     = 0x80
+	SPI_MODE_TX_DUAL   = 0x100 // Transmit using 2 data lines
+	SPI_MODE_TX_QUAD   = 0x200 // Transmit using 4 data lines
+	SPI_MODE_RX_DUAL   = 0x400 // Receive using 2 data lines
+	SPI_MODE_RX_QUAD   = 0x800 // Receive using 4 data lines
 )
 
 const spiCode uintptr = 'k'
 
 var (
-	spiXfer       = iocW(spiCode, 0, unsafe.Sizeof(spi_xfer{}))
 	spiRdMode     = iocR(spiCode, 1, unsafe.Sizeof(byte(0)))
 	spiWrMode     = iocW(spiCode, 1, unsafe.Sizeof(byte(0)))
 	spiRdLsbFirst = iocR(spiCode, 2, unsafe.Sizeof(byte(0)))
@@ -61,10 +69,51 @@ var (
 	spiWrMode32   = iocW(spiCode, 5, unsafe.Sizeof(uint32(0)))
 )
 
+// SpiMaxTransfers is the maximum number of segments in a transaction,
+// limited by the size field of the ioctl request.
+const SpiMaxTransfers = (1<<14 - 1) / int(unsafe.Sizeof(spi_xfer{}))
+
+// spiMessage returns the SPI_IOC_MESSAGE(n) request.
+func spiMessage(n int) uintptr {
+	return iocW(spiCode, 0, uintptr(n)*unsafe.Sizeof(spi_xfer{}))
+}
+
 type Spi struct {
-	bus  byte
-	cs   byte
-	file *os.File
+	bus   int
+	cs    int
+	file  *os.File
+	speed uint32 // Configured speed, applied to each transfer
+	bits  byte   // Configured word size, applied to each transfer
+	mode  uint32
+}
+
+// SpiDev is the bus and chip select of a /dev/spidev device.
+type SpiDev struct {
+	Bus, Cs int
+}
+
+// SpiTransfer is one segment of a SPI transaction.
+// If Tx is nil, zeros are written, and if Rx is nil, the data read is
+// discarded. If both are set, they must be the same length, and the
+// device must not be in 3 wire mode.
+// TxNbits and RxNbits select the number of data lines used (1, 2 or 4),
+// which must be enabled in the mode of the device.
+type SpiTransfer struct {
+	Tx       []byte
+	Rx       []byte
+	Speed    uint32        // Speed in Hz, 0 selects the configured speed
+	Bits     byte          // Word size, 0 selects the configured word size
+	Delay    time.Duration // Delay after the segment, in microseconds resolution
+	CsChange bool          // Deselect the device after the segment
+	TxNbits  byte          // Transmit width, 0 for single
+	RxNbits  byte          // Receive width, 0 for single
+}
+
+// SpiConfig is the mode, speed (in Hz) and word size of a SPI device.
+type SpiConfig struct {
+	Mode  uint32
+	Speed uint32
+	Bits  byte
 }
 
 type spi_xfer struct {
@@ -82,37 +131,174 @@ type spi_xfer struct {
 	_        uint16
 }
 
-// NewSpi creates and initialises a SPI device.
-func NewSpi(unit int) (*Spi, error) {
-	if unit > len(spiDevs) {
-		return nil, os.ErrNotExist
+// NewSpi creates and initialises a SPI device, where the unit selects
+// one of the SPI devices of a Raspberry Pi (spidev0.0, spidev0.1,
+// spidev1.0, spidev1.1 and spidev1.2). OpenSpi may be used to open
+// any SPI device.
+func NewSpi(unit int, opts ...Option) (*Spi, error) {
+	if unit < 0 || unit >= len(spiDevs) {
+		return nil, busError(fmt.Sprintf("spi unit %d", unit), -1, "open", os.ErrNotExist)
+	}
+	return OpenSpi(spiDevs[unit].Bus, spiDevs[unit].Cs, opts...)
+}
+
+// OpenSpi creates and initialises the SPI device for the bus and chip select.
+// The Consumer option may be used to label the device in the registry.
+func OpenSpi(bus, cs int, opts ...Option) (*Spi, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
 	}
 	s := new(Spi)
-	s.bus = spiDevs[unit].bus
-	s.cs = spiDevs[unit].cs
-	var err error
-	s.file, err = os.OpenFile(fmt.Sprintf("/dev/spidev%d.%d", s.bus, s.cs), os.O_RDWR, 0600)
+	s.bus = bus
+	s.cs = cs
+	err = reserve(s.resource(), cfg.consumer, false)
 	if err != nil {
 		return nil, err
 	}
-	s.Speed(100 * 1000)
-	s.Bits(8)
-	s.Mode(0)
+	s.file, err = os.OpenFile(rootPath(fmt.Sprintf("/dev/spidev%d.%d", s.bus, s.cs)), os.O_RDWR, 0600)
+	if err != nil {
+		release(s.resource())
+		return nil, busError(s.resource(), -1, "open", err)
+	}
+	err = s.Speed(100 * 1000)
+	if err == nil {
+		err = s.Bits(8)
+	}
+	if err == nil {
+		err = s.Mode(0)
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
 	return s, nil
 }
 
-// Xfer builds and sends a message request.
+// checkWidth validates the transfer against the mode of the device.
+func (s *Spi) checkWidth(t *SpiTransfer) error {
+	if s.mode&SPI_MODE_3WIRE != 0 && t.Tx != nil && t.Rx != nil {
+		return fmt.Errorf("3 wire mode requires half duplex transfers: %w", os.ErrInvalid)
+	}
+	widths := []struct {
+		nbits      byte
+		dual, quad uint32
+	}{
+		{t.TxNbits, SPI_MODE_TX_DUAL, SPI_MODE_TX_QUAD},
+		{t.RxNbits, SPI_MODE_RX_DUAL, SPI_MODE_RX_QUAD},
+	}
+	for _, w := range widths {
+		switch w.nbits {
+		case 0, 1:
+		case 2:
+			if s.mode&(w.dual|w.quad) == 0 {
+				return fmt.Errorf("dual transfer not enabled in mode 0x%x: %w", s.mode, ErrNotSupported)
+			}
+		case 4:
+			if s.mode&w.quad == 0 {
+				return fmt.Errorf("quad transfer not enabled in mode 0x%x: %w", s.mode, ErrNotSupported)
+			}
+		default:
+			return fmt.Errorf("invalid transfer width %d: %w", w.nbits, os.ErrInvalid)
+		}
+	}
+	return nil
+}
+
+// SpiDevices returns the SPI devices that are present, sorted
+// by bus and chip select.
+func SpiDevices() ([]SpiDev, error) {
+	m, err := filepath.Glob(rootPath("/dev/spidev*"))
+	if err != nil {
+		return nil, err
+	}
+	var devs []SpiDev
+	for _, f := range m {
+		var d SpiDev
+		if n, err := fmt.Sscanf(filepath.Base(f), "spidev%d.%d", &d.Bus, &d.Cs); err == nil && n == 2 {
+			devs = append(devs, d)
+		}
+	}
+	sort.Slice(devs, func(i, j int) bool {
+		if devs[i].Bus != devs[j].Bus {
+			return devs[i].Bus < devs[j].Bus
+		}
+		return devs[i].Cs < devs[j].Cs
+	})
+	return devs, nil
+}
+
+// Xfer builds and sends a message request, using the configured
+// speed and word size.
 // The receive buffer is returned.
-// TODO: The interface will support multiple messages.
 func (s *Spi) Xfer(wb []byte) ([]byte, error) {
-	x := new(spi_xfer)
-	x.txb = int64(uintptr(unsafe.Pointer(&wb[0])))
+	return s.XferWith(wb, 0, 0)
+}
+
+// XferWith is the same as Xfer, but overrides the speed and word size
+// for this transfer. A zero speed or word size selects the configured value.
+func (s *Spi) XferWith(wb []byte, speed uint32, bits byte) ([]byte, error) {
 	rb := make([]byte, len(wb))
-	x.rxb = int64(uintptr(unsafe.Pointer(&rb[0])))
-	x.ln = uint32(len(wb))
-	x.speed = 100 * 1000
-	x.bits = 8
-	return rb, ioctl(s.file.Fd(), spiXfer, uintptr(unsafe.Pointer(x)))
+	err := s.Transfer([]SpiTransfer{{Tx: wb, Rx: rb, Speed: speed, Bits: bits}})
+	return rb, err
+}
+
+// Transfer sends the segments as a single transaction, with the device
+// selected for the whole transaction unless CsChange is set on a segment.
+func (s *Spi) Transfer(ts []SpiTransfer) error {
+	if len(ts) == 0 || len(ts) > SpiMaxTransfers {
+		return busError(s.resource(), -1, "transfer", os.ErrInvalid)
+	}
+	xs := make([]spi_xfer, len(ts))
+	for i := range ts {
+		t := &ts[i]
+		n := len(t.Tx)
+		if t.Tx == nil {
+			n = len(t.Rx)
+		}
+		us := (t.Delay + time.Microsecond - 1) / time.Microsecond
+		if n == 0 || (t.Tx != nil && t.Rx != nil && len(t.Rx) != n) || us < 0 || us > 0xFFFF {
+			return busError(s.resource(), -1, "transfer", os.ErrInvalid)
+		}
+		if err := s.checkWidth(t); err != nil {
+			return busError(s.resource(), -1, "transfer", err)
+		}
+		x := &xs[i]
+		if t.Tx != nil {
+			x.txb = int64(uintptr(unsafe.Pointer(&t.Tx[0])))
+		}
+		if t.Rx != nil {
+			x.rxb = int64(uintptr(unsafe.Pointer(&t.Rx[0])))
+		}
+		x.ln = uint32(n)
+		x.speed = t.Speed
+		if x.speed == 0 {
+			x.speed = s.speed
+		}
+		x.bits = t.Bits
+		if x.bits == 0 {
+			x.bits = s.bits
+		}
+		x.delay = uint16(us)
+		if t.CsChange {
+			x.cs = 1
+		}
+		x.tx_nbits = t.TxNbits
+		x.rx_nbits = t.RxNbits
+	}
+	err := ioctl(s.file.Fd(), spiMessage(len(xs)), uintptr(unsafe.Pointer(&xs[0])))
+	runtime.KeepAlive(ts)
+	return busError(s.resource(), -1, "transfer", err)
+}
+
+// XferContext is the same as Xfer, but returns the context error
+// without starting the transfer if the context is done.
+// A transfer that has been started cannot be aborted.
+func (s *Spi) XferContext(ctx context.Context, wb []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Xfer(wb)
 }
 
 // Write writes the message to the SPI device.
@@ -127,20 +313,69 @@ func (s *Spi) Read(b []byte) (int, error) {
 
 // Speed sets the speed of the interface.
 func (s *Spi) Speed(speed uint32) error {
-	return ioctl32(s.file.Fd(), spiWrSpeed, &speed)
+	if err := ioctl32(s.file.Fd(), spiWrSpeed, &speed); err != nil {
+		return busError(s.resource(), -1, "speed", err)
+	}
+	s.speed = speed
+	return nil
 }
 
 // Bits selects the word size of the transfer (usually 8 or 9 bits)
 func (s *Spi) Bits(bits byte) error {
-	return ioctl8(s.file.Fd(), spiWrBits, &bits)
+	if err := ioctl8(s.file.Fd(), spiWrBits, &bits); err != nil {
+		return busError(s.resource(), -1, "bits", err)
+	}
+	s.bits = bits
+	return nil
 }
 
 // Mode sets the mode, which is a combination of mode flags.
+// The mode is read back from the driver, and if the driver has not
+// enabled all the flags requested (such as dual or quad transfers that the
+// controller does not support), an error matching ErrNotSupported is
+// returned, and the mode is set to the flags that were enabled.
 func (s *Spi) Mode(m uint32) error {
-	return ioctl32(s.file.Fd(), spiWrMode32, &m)
+	if err := ioctl32(s.file.Fd(), spiWrMode32, &m); err != nil {
+		return busError(s.resource(), -1, "mode", err)
+	}
+	var rm uint32
+	if err := ioctl32(s.file.Fd(), spiRdMode32, &rm); err != nil {
+		return busError(s.resource(), -1, "mode", err)
+	}
+	s.mode = rm
+	if rm&m != m {
+		return busError(s.resource(), -1, "mode", fmt.Errorf("mode 0x%x set as 0x%x: %w", m, rm, ErrNotSupported))
+	}
+	return nil
+}
+
+// Config returns the configured mode, speed and word size.
+func (s *Spi) Config() SpiConfig {
+	return SpiConfig{Mode: s.mode, Speed: s.speed, Bits: s.bits}
+}
+
+// ReadConfig reads the effective mode, speed and word size from the driver.
+func (s *Spi) ReadConfig() (SpiConfig, error) {
+	var c SpiConfig
+	if err := ioctl32(s.file.Fd(), spiRdMode32, &c.Mode); err != nil {
+		return c, busError(s.resource(), -1, "mode", err)
+	}
+	if err := ioctl32(s.file.Fd(), spiRdSpeed, &c.Speed); err != nil {
+		return c, busError(s.resource(), -1, "speed", err)
+	}
+	if err := ioctl8(s.file.Fd(), spiRdBits, &c.Bits); err != nil {
+		return c, busError(s.resource(), -1, "bits", err)
+	}
+	return c, nil
 }
 
 // Close closes the SPI controller
 func (s *Spi) Close() {
 	s.file.Close()
+	release(s.resource())
+}
+
+// resource returns the name of the SPI device in the registry.
+func (s *Spi) resource() string {
+	return fmt.Sprintf("spidev%d.%d", s.bus, s.cs)
 }
@@ -0,0 +1,371 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package io
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// fakeSpi is a fake spidev driver.
+type fakeSpi struct {
+	supported uint32 // Mode flags the controller supports
+	mode      uint32
+	speed     uint32
+	bits      byte
+	req       uintptr    // Last message request
+	xfers     []spi_xfer // Segments of the last message
+}
+
+// newFakeSpi creates the devices under a temporary root, and
+// replaces ioctl with the fake driver.
+func newFakeSpi(t *testing.T, devs ...string) *fakeSpi {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "dev"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range devs {
+		if err := os.WriteFile(filepath.Join(root, "dev", d), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f := &fakeSpi{supported: 0xFFF}
+	oldRoot, oldIoctl := Root, ioctl
+	Root, ioctl = root, f.ioctl
+	t.Cleanup(func() { Root, ioctl = oldRoot, oldIoctl })
+	return f
+}
+
+func (f *fakeSpi) ioctl(fd, req, arg uintptr) error {
+	switch req {
+	case spiWrSpeed:
+		f.speed = *(*uint32)(ptr(arg))
+	case spiRdSpeed:
+		*(*uint32)(ptr(arg)) = f.speed
+	case spiWrBits:
+		f.bits = *(*byte)(ptr(arg))
+	case spiRdBits:
+		*(*byte)(ptr(arg)) = f.bits
+	case spiWrMode32:
+		// Flags the controller does not support are dropped, as the
+		// driver does for dual and quad transfers.
+		f.mode = *(*uint32)(ptr(arg)) & f.supported
+	case spiRdMode32:
+		*(*uint32)(ptr(arg)) = f.mode
+	default:
+		n := int(req>>16&(1<<14-1)) / int(unsafe.Sizeof(spi_xfer{}))
+		if req != spiMessage(n) || n == 0 {
+			return unix.ENOTTY
+		}
+		f.req = req
+		f.xfers = append([]spi_xfer(nil), (*[SpiMaxTransfers]spi_xfer)(ptr(arg))[:n:n]...)
+		// The data written is looped back.
+		for _, x := range f.xfers {
+			if x.rxb == 0 {
+				continue
+			}
+			rx := (*[1 << 16]byte)(ptr(uintptr(x.rxb)))[:x.ln:x.ln]
+			if x.txb != 0 {
+				copy(rx, (*[1 << 16]byte)(ptr(uintptr(x.txb)))[:x.ln:x.ln])
+			} else {
+				for i := range rx {
+					rx[i] = 0
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func TestOpenSpi(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "dev"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "dev", "spidev0.0"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var fail uintptr
+	oldRoot, oldIoctl := Root, ioctl
+	Root = root
+	ioctl = func(fd, req, arg uintptr) error {
+		if req == fail {
+			return unix.EINVAL
+		}
+		return nil
+	}
+	t.Cleanup(func() { Root, ioctl = oldRoot, oldIoctl })
+
+	for _, tc := range []struct {
+		req uintptr
+		op  string
+	}{{spiWrSpeed, "speed"}, {spiWrBits, "bits"}, {spiWrMode32, "mode"}} {
+		fail = tc.req
+		_, err := OpenSpi(0, 0)
+		var be *BusError
+		if !errors.Is(err, unix.EINVAL) || !errors.As(err, &be) || be.Op != tc.op {
+			t.Errorf("OpenSpi with %s failing: got %v, want %s error", tc.op, err, tc.op)
+		}
+		if a := Allocations(); len(a) != 0 {
+			t.Errorf("OpenSpi with %s failing: allocations %v", tc.op, a)
+		}
+	}
+	fail = 0
+	s, err := OpenSpi(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+}
+
+func TestSpiXferWith(t *testing.T) {
+	f := newFakeSpi(t, "spidev0.0")
+	s, err := OpenSpi(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// The defaults set when opened.
+	if c := s.Config(); c != (SpiConfig{Mode: 0, Speed: 100000, Bits: 8}) {
+		t.Errorf("Config: got %+v", c)
+	}
+	wb := []byte{1, 2, 3}
+	if _, err := s.Xfer(wb); err != nil {
+		t.Fatal(err)
+	}
+	if f.xfers[0].speed != 100000 || f.xfers[0].bits != 8 {
+		t.Errorf("Xfer: got speed %d, bits %d, want 100000, 8", f.xfers[0].speed, f.xfers[0].bits)
+	}
+	if err := s.Speed(1000000); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Bits(9); err != nil {
+		t.Fatal(err)
+	}
+	if c := s.Config(); c != (SpiConfig{Mode: 0, Speed: 1000000, Bits: 9}) {
+		t.Errorf("Config: got %+v", c)
+	}
+	for _, tc := range []struct {
+		speed uint32
+		bits  byte
+		wantS uint32
+		wantB byte
+	}{
+		{0, 0, 1000000, 9},
+		{500000, 16, 500000, 16},
+		{0, 12, 1000000, 12},
+		{250000, 0, 250000, 9},
+	} {
+		rb, err := s.XferWith(wb, tc.speed, tc.bits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rb, wb) {
+			t.Errorf("XferWith(%d, %d): read %v, want %v", tc.speed, tc.bits, rb, wb)
+		}
+		if len(f.xfers) != 1 || f.xfers[0].speed != tc.wantS || f.xfers[0].bits != tc.wantB {
+			t.Errorf("XferWith(%d, %d): got %+v, want speed %d, bits %d", tc.speed, tc.bits, f.xfers, tc.wantS, tc.wantB)
+		}
+	}
+	// The overrides do not change the configuration.
+	if c := s.Config(); c != (SpiConfig{Mode: 0, Speed: 1000000, Bits: 9}) {
+		t.Errorf("Config after XferWith: got %+v", c)
+	}
+	if f.speed != 1000000 || f.bits != 9 {
+		t.Errorf("driver after XferWith: speed %d, bits %d", f.speed, f.bits)
+	}
+	if _, err := s.Xfer(wb); err != nil {
+		t.Fatal(err)
+	}
+	if f.xfers[0].speed != 1000000 || f.xfers[0].bits != 9 {
+		t.Errorf("Xfer: got speed %d, bits %d, want 1000000, 9", f.xfers[0].speed, f.xfers[0].bits)
+	}
+}
+
+func TestSpiTransfer(t *testing.T) {
+	f := newFakeSpi(t, "spidev0.0")
+	s, err := OpenSpi(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Mode(SPI_MODE_TX_DUAL | SPI_MODE_RX_QUAD); err != nil {
+		t.Fatal(err)
+	}
+	tx0, tx2 := []byte{1, 2}, []byte{5, 6, 7}
+	rx1, rx2 := make([]byte, 4), make([]byte, 3)
+	ts := []SpiTransfer{
+		{Tx: tx0, CsChange: true, Delay: 1500 * time.Nanosecond, TxNbits: 2},
+		{Rx: rx1, Speed: 2000000, RxNbits: 4},
+		{Tx: tx2, Rx: rx2, Bits: 16, Delay: 10 * time.Microsecond},
+	}
+	if err := s.Transfer(ts); err != nil {
+		t.Fatal(err)
+	}
+	// SPI_IOC_MESSAGE(1) is 0x40206b00.
+	if f.req != spiMessage(3) || spiMessage(1) != 0x40206b00 {
+		t.Errorf("request: got 0x%x, want 0x%x", f.req, spiMessage(3))
+	}
+	addr := func(b []byte) int64 {
+		return int64(uintptr(unsafe.Pointer(&b[0])))
+	}
+	want := []spi_xfer{
+		{txb: addr(tx0), ln: 2, speed: 100000, delay: 2, bits: 8, cs: 1, tx_nbits: 2},
+		{rxb: addr(rx1), ln: 4, speed: 2000000, bits: 8, rx_nbits: 4},
+		{txb: addr(tx2), rxb: addr(rx2), ln: 3, speed: 100000, delay: 10, bits: 16},
+	}
+	if len(f.xfers) != len(want) {
+		t.Fatalf("got %d segments, want %d", len(f.xfers), len(want))
+	}
+	for i := range want {
+		if f.xfers[i] != want[i] {
+			t.Errorf("segment %d: got %+v, want %+v", i, f.xfers[i], want[i])
+		}
+	}
+	if !bytes.Equal(rx1, make([]byte, 4)) || !bytes.Equal(rx2, tx2) {
+		t.Errorf("read %v and %v, want zeros and %v", rx1, rx2, tx2)
+	}
+
+	// The size of the request limits the number of segments.
+	if SpiMaxTransfers != 511 {
+		t.Errorf("SpiMaxTransfers: got %d, want 511", SpiMaxTransfers)
+	}
+	f.req = 0
+	ts = make([]SpiTransfer, SpiMaxTransfers+1)
+	for i := range ts {
+		ts[i].Tx = []byte{byte(i)}
+	}
+	if err := s.Transfer(ts); !errors.Is(err, os.ErrInvalid) || f.req != 0 {
+		t.Errorf("%d segments: got %v, request 0x%x, want ErrInvalid", len(ts), err, f.req)
+	}
+	if err := s.Transfer(ts[:SpiMaxTransfers]); err != nil || f.req != spiMessage(SpiMaxTransfers) || len(f.xfers) != SpiMaxTransfers {
+		t.Errorf("%d segments: got %v, request 0x%x", SpiMaxTransfers, err, f.req)
+	}
+	if err := s.Transfer(nil); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("no segments: got %v, want ErrInvalid", err)
+	}
+}
+
+func TestSpiDevices(t *testing.T) {
+	newFakeSpi(t, "spidev1.10", "spidev0.1", "spidev1.2", "spidev0.0", "spidev2", "spidevx.0")
+	devs, err := SpiDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SpiDev{{0, 0}, {0, 1}, {1, 2}, {1, 10}}
+	if !reflect.DeepEqual(devs, want) {
+		t.Errorf("SpiDevices: got %v, want %v", devs, want)
+	}
+	newFakeSpi(t)
+	if devs, err := SpiDevices(); err != nil || len(devs) != 0 {
+		t.Errorf("SpiDevices with no devices: got %v, %v", devs, err)
+	}
+}
+
+func TestNewSpi(t *testing.T) {
+	newFakeSpi(t, "spidev0.0", "spidev1.0")
+	for _, unit := range []int{-1, len(spiDevs)} {
+		var be *BusError
+		if _, err := NewSpi(unit); !errors.Is(err, os.ErrNotExist) || !errors.As(err, &be) {
+			t.Errorf("NewSpi(%d): got %v, want ErrNotExist", unit, err)
+		}
+	}
+	s, err := NewSpi(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := Allocations(); len(a) != 1 || a[0].Resource != "spidev1.0" {
+		t.Errorf("NewSpi(2): allocations %v, want spidev1.0", a)
+	}
+	s.Close()
+	// The unit exists, but the device does not.
+	if _, err := NewSpi(1); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("NewSpi(1): got %v, want ErrNotExist", err)
+	}
+}
+
+func TestSpiWidth(t *testing.T) {
+	f := newFakeSpi(t, "spidev0.0")
+	s, err := OpenSpi(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	b := []byte{1}
+	for _, tc := range []struct {
+		mode uint32
+		t    SpiTransfer
+		want error // nil for success
+	}{
+		{SPI_MODE_3WIRE, SpiTransfer{Tx: b}, nil},
+		{SPI_MODE_3WIRE, SpiTransfer{Rx: make([]byte, 1)}, nil},
+		{SPI_MODE_3WIRE, SpiTransfer{Tx: b, Rx: make([]byte, 1)}, os.ErrInvalid},
+		{0, SpiTransfer{Tx: b, TxNbits: 1, RxNbits: 1}, nil},
+		{0, SpiTransfer{Tx: b, TxNbits: 2}, ErrNotSupported},
+		{0, SpiTransfer{Tx: b, RxNbits: 4}, ErrNotSupported},
+		{SPI_MODE_TX_DUAL, SpiTransfer{Tx: b, TxNbits: 2}, nil},
+		{SPI_MODE_TX_DUAL, SpiTransfer{Tx: b, TxNbits: 4}, ErrNotSupported},
+		{SPI_MODE_TX_DUAL, SpiTransfer{Tx: b, RxNbits: 2}, ErrNotSupported},
+		{SPI_MODE_TX_QUAD, SpiTransfer{Tx: b, TxNbits: 2}, nil},
+		{SPI_MODE_TX_QUAD, SpiTransfer{Tx: b, TxNbits: 4}, nil},
+		{SPI_MODE_RX_DUAL, SpiTransfer{Tx: b, RxNbits: 2}, nil},
+		{SPI_MODE_RX_DUAL, SpiTransfer{Tx: b, RxNbits: 4}, ErrNotSupported},
+		{SPI_MODE_RX_QUAD, SpiTransfer{Tx: b, RxNbits: 4}, nil},
+		{SPI_MODE_RX_QUAD, SpiTransfer{Tx: b, TxNbits: 4}, ErrNotSupported},
+		{SPI_MODE_TX_QUAD | SPI_MODE_RX_QUAD, SpiTransfer{Tx: b, TxNbits: 3}, os.ErrInvalid},
+	} {
+		if err := s.Mode(tc.mode); err != nil {
+			t.Fatal(err)
+		}
+		f.req = 0
+		err := s.Transfer([]SpiTransfer{tc.t})
+		if tc.want == nil {
+			if err != nil || f.req == 0 {
+				t.Errorf("mode 0x%x, %+v: got %v, want success", tc.mode, tc.t, err)
+			}
+		} else if !errors.Is(err, tc.want) || f.req != 0 {
+			t.Errorf("mode 0x%x, %+v: got %v, request 0x%x, want %v", tc.mode, tc.t, err, f.req, tc.want)
+		}
+	}
+
+	// The controller does not support quad transfers, so the mode
+	// read back does not have them enabled.
+	f.supported = 0xFF &^ SPI_MODE_LOOP
+	err = s.Mode(SPI_MODE_3 | SPI_MODE_TX_QUAD | SPI_MODE_RX_DUAL)
+	var be *BusError
+	if !errors.Is(err, ErrNotSupported) || !errors.As(err, &be) || be.Op != "mode" {
+		t.Errorf("Mode: got %v, want ErrNotSupported", err)
+	}
+	if c := s.Config(); c.Mode != SPI_MODE_3 {
+		t.Errorf("Config: got mode 0x%x, want 0x%x", c.Mode, SPI_MODE_3)
+	}
+	if err := s.Transfer([]SpiTransfer{{Tx: b, TxNbits: 4}}); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("quad transfer: got %v, want ErrNotSupported", err)
+	}
+	if err := s.Mode(SPI_MODE_LOOP); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("Mode(SPI_MODE_LOOP): got %v, want ErrNotSupported", err)
+	}
+	if err := s.Mode(SPI_MODE_CS_HIGH | SPI_MODE_3WIRE); err != nil {
+		t.Errorf("Mode: %v", err)
+	}
+}
@@ -0,0 +1,525 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sysfstest emulates the sysfs GPIO and PWM interfaces in a
+// directory tree, so that the io package can be exercised without hardware.
+//
+// A typical use is:
+//
+//	fs, err := sysfstest.New(dir)
+//	...
+//	defer fs.Close()
+//	io.Root = fs.Root()
+//	io.Verify = true
+//
+// The emulation runs asynchronously by watching the tree with inotify, so
+// io.Verify must be set so that the io package waits for exported files to
+// appear, and a value written to an attribute should be observed (such as
+// via Pwm) before the attribute is written again.
+//
+// Regular files do not support sysfs poll notification, so an edge set
+// via SetValue is signalled through an eventfd held for each exported
+// GPIO, and Poll emulates poll(2) for the value files using the eventfd.
+// Tests within the io package replace its poll function with Poll to
+// wait for edges.
+package sysfstest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	gpioDir = "sys/class/gpio"
+	pwmDir  = "sys/class/pwm/pwmchip0"
+	devDir  = "dev"
+)
+
+// Attribute values for the different attribute files.
+var attrValues = map[string][]string{
+	"direction":  {"in", "out", "high", "low"},
+	"edge":       {"none", "rising", "falling", "both"},
+	"active_low": {"0", "1"},
+	"value":      {"0", "1"},
+}
+
+type gpioState struct {
+	dir   string
+	attrs map[string]string
+	ino   uint64 // Inode of the value file
+	edge  int    // Eventfd signalled when an edge is detected
+}
+
+type pwmState struct {
+	dir    string
+	period int64
+	duty   int64
+	enable bool
+}
+
+// Sysfs is an emulated sysfs tree.
+type Sysfs struct {
+	root    string
+	ifd     int
+	wake    [2]int
+	done    chan struct{}
+	close   sync.Once
+	mu      sync.Mutex
+	watches map[int]string // Maps watch descriptor to directory
+	polling int            // Number of Poll calls waiting for an edge
+	gpios   map[int]*gpioState
+	pwms    map[int]*pwmState
+}
+
+// New creates the emulated GPIO and PWM sysfs directories under root, and
+// starts a goroutine to emulate the sysfs export and attribute semantics.
+// An empty dev directory is also created for device nodes.
+func New(root string) (*Sysfs, error) {
+	f := &Sysfs{root: root, watches: make(map[int]string), gpios: make(map[int]*gpioState), pwms: make(map[int]*pwmState)}
+	for _, d := range []string{gpioDir, pwmDir, devDir} {
+		if err := os.MkdirAll(filepath.Join(root, d), 0755); err != nil {
+			return nil, err
+		}
+	}
+	for _, d := range []string{gpioDir, pwmDir} {
+		for _, n := range []string{"export", "unexport"} {
+			if err := os.WriteFile(filepath.Join(root, d, n), nil, 0644); err != nil {
+				return nil, err
+			}
+		}
+	}
+	var err error
+	f.ifd, err = unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Pipe2(f.wake[:], unix.O_CLOEXEC); err != nil {
+		unix.Close(f.ifd)
+		return nil, err
+	}
+	for _, d := range []string{gpioDir, pwmDir} {
+		if err := f.watch(filepath.Join(root, d)); err != nil {
+			f.closeFds()
+			return nil, err
+		}
+	}
+	f.done = make(chan struct{})
+	go f.run()
+	return f, nil
+}
+
+// Root returns the root of the emulated tree, suitable for io.Root.
+func (f *Sysfs) Root() string {
+	return f.root
+}
+
+// Close stops the emulation. The directory tree is not removed.
+func (f *Sysfs) Close() error {
+	f.close.Do(func() {
+		unix.Write(f.wake[1], []byte{0})
+		<-f.done
+		f.closeFds()
+		f.mu.Lock()
+		for _, g := range f.gpios {
+			unix.Close(g.edge)
+		}
+		f.mu.Unlock()
+	})
+	return nil
+}
+
+// Exported returns true if the GPIO is currently exported.
+func (f *Sysfs) Exported(gpio int) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.gpios[gpio] != nil
+}
+
+// Direction returns the current direction ("in" or "out") of an exported GPIO.
+func (f *Sysfs) Direction(gpio int) (string, error) {
+	return f.attr(gpio, "direction")
+}
+
+// Edge returns the current edge setting of an exported GPIO.
+func (f *Sysfs) Edge(gpio int) (string, error) {
+	return f.attr(gpio, "edge")
+}
+
+// ActiveLow returns the current active_low setting of an exported GPIO.
+func (f *Sysfs) ActiveLow(gpio int) (bool, error) {
+	v, err := f.attr(gpio, "active_low")
+	return v == "1", err
+}
+
+// Value returns the current value of an exported GPIO.
+func (f *Sysfs) Value(gpio int) (int, error) {
+	v, err := f.attr(gpio, "value")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(v)
+}
+
+// SetValue drives the value of an exported GPIO that is an input,
+// emulating an external signal. If the change of level matches the edge
+// setting of the GPIO, an edge is signalled.
+func (f *Sysfs) SetValue(gpio, v int) error {
+	if v != 0 && v != 1 {
+		return os.ErrInvalid
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	g := f.gpios[gpio]
+	if g == nil {
+		return fmt.Errorf("gpio%d: not exported", gpio)
+	}
+	if g.attrs["direction"] != "in" {
+		return fmt.Errorf("gpio%d: not an input", gpio)
+	}
+	old := g.attrs["value"]
+	g.attrs["value"] = strconv.Itoa(v)
+	if err := f.writeAttr(g.dir, "value", g.attrs["value"]); err != nil {
+		return err
+	}
+	if old == g.attrs["value"] {
+		return nil
+	}
+	switch g.attrs["edge"] {
+	case "rising":
+		if v == 0 {
+			return nil
+		}
+	case "falling":
+		if v == 1 {
+			return nil
+		}
+	case "both":
+	default:
+		return nil
+	}
+	_, err := unix.Write(g.edge, []byte{1, 0, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// Poll is a replacement for unix.Poll that emulates the sysfs edge
+// notification of the value files. A descriptor open on the value file of
+// an exported GPIO that is polled for POLLPRI or POLLERR reports both when
+// an edge has been signalled by SetValue. The edge remains pending until
+// it is reported. Other descriptors are polled unchanged.
+func (f *Sysfs) Poll(fds []unix.PollFd, timeout int) (int, error) {
+	pfd := make([]unix.PollFd, len(fds))
+	copy(pfd, fds)
+	edges := make([]int, len(fds))
+	waiting := false
+	f.mu.Lock()
+	for i := range pfd {
+		edges[i] = -1
+		if pfd[i].Events&(unix.POLLPRI|unix.POLLERR) == 0 {
+			continue
+		}
+		var st unix.Stat_t
+		if unix.Fstat(int(pfd[i].Fd), &st) != nil {
+			continue
+		}
+		for _, g := range f.gpios {
+			if g.ino == st.Ino {
+				edges[i] = g.edge
+				pfd[i] = unix.PollFd{Fd: int32(g.edge), Events: unix.POLLIN}
+				waiting = true
+			}
+		}
+	}
+	if waiting {
+		f.polling++
+	}
+	f.mu.Unlock()
+	n, err := unix.Poll(pfd, timeout)
+	if waiting {
+		f.mu.Lock()
+		f.polling--
+		f.mu.Unlock()
+	}
+	for i := range fds {
+		fds[i].Revents = pfd[i].Revents
+		if edges[i] >= 0 && pfd[i].Revents&unix.POLLIN != 0 {
+			var b [8]byte
+			unix.Read(edges[i], b[:])
+			fds[i].Revents = unix.POLLPRI | unix.POLLERR
+		}
+	}
+	return n, err
+}
+
+// Polling returns the number of calls to Poll that are waiting for an edge.
+func (f *Sysfs) Polling() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.polling
+}
+
+// PwmExported returns true if the PWM unit is currently exported.
+func (f *Sysfs) PwmExported(unit int) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.pwms[unit] != nil
+}
+
+// Pwm returns the last period and duty cycle (in nanoseconds) written
+// to the PWM unit, and whether the unit is enabled.
+func (f *Sysfs) Pwm(unit int) (period, duty int64, enabled bool, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p := f.pwms[unit]
+	if p == nil {
+		return 0, 0, false, fmt.Errorf("pwm%d: not exported", unit)
+	}
+	return p.period, p.duty, p.enable, nil
+}
+
+// attr returns the current value of a GPIO attribute.
+func (f *Sysfs) attr(gpio int, name string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	g := f.gpios[gpio]
+	if g == nil {
+		return "", fmt.Errorf("gpio%d: not exported", gpio)
+	}
+	return g.attrs[name], nil
+}
+
+// watch adds an inotify watch for modifications in a directory.
+func (f *Sysfs) watch(dir string) error {
+	wd, err := unix.InotifyAddWatch(f.ifd, dir, unix.IN_MODIFY)
+	if err != nil {
+		return err
+	}
+	f.watches[wd] = dir
+	return nil
+}
+
+func (f *Sysfs) closeFds() {
+	unix.Close(f.ifd)
+	unix.Close(f.wake[0])
+	unix.Close(f.wake[1])
+}
+
+// run reads the inotify events and emulates the sysfs semantics.
+func (f *Sysfs) run() {
+	defer close(f.done)
+	buf := make([]byte, 4096)
+	pfd := []unix.PollFd{{Fd: int32(f.ifd), Events: unix.POLLIN}, {Fd: int32(f.wake[0]), Events: unix.POLLIN}}
+	for {
+		_, err := unix.Poll(pfd, -1)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil || pfd[1].Revents != 0 {
+			return
+		}
+		n, err := unix.Read(f.ifd, buf)
+		if err != nil {
+			return
+		}
+		for i := 0; i+unix.SizeofInotifyEvent <= n; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[i]))
+			name := strings.TrimRight(string(buf[i+unix.SizeofInotifyEvent:i+unix.SizeofInotifyEvent+int(ev.Len)]), "\x00")
+			i += unix.SizeofInotifyEvent + int(ev.Len)
+			f.mu.Lock()
+			if dir, ok := f.watches[int(ev.Wd)]; ok && ev.Mask&unix.IN_MODIFY != 0 {
+				f.modified(dir, name)
+			}
+			if ev.Mask&unix.IN_IGNORED != 0 {
+				delete(f.watches, int(ev.Wd))
+			}
+			f.mu.Unlock()
+		}
+	}
+}
+
+// modified handles a write to a file in a watched directory.
+func (f *Sysfs) modified(dir, name string) {
+	b, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil || len(b) == 0 {
+		return
+	}
+	s := strings.TrimSpace(string(b))
+	switch dir {
+	case filepath.Join(f.root, gpioDir):
+		f.exportGpio(name, s)
+	case filepath.Join(f.root, pwmDir):
+		f.exportPwm(name, s)
+	default:
+		if strings.HasPrefix(filepath.Base(dir), "pwm") {
+			f.pwmAttr(dir, name, s)
+		} else {
+			f.gpioAttr(dir, name, s)
+		}
+	}
+}
+
+// exportGpio handles writes to the GPIO export and unexport files.
+func (f *Sysfs) exportGpio(name, s string) {
+	os.Truncate(filepath.Join(f.root, gpioDir, name), 0)
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return
+	}
+	dir := filepath.Join(f.root, gpioDir, fmt.Sprintf("gpio%d", n))
+	switch name {
+	case "export":
+		if f.gpios[n] != nil || os.Mkdir(dir, 0755) != nil {
+			return
+		}
+		g := &gpioState{dir: dir, attrs: map[string]string{"direction": "in", "edge": "none", "active_low": "0", "value": "0"}}
+		// Watch the directory before creating the attribute files so
+		// that no writes are missed, and create the value file last since
+		// that is the file that is waited upon.
+		if f.watch(dir) != nil {
+			return
+		}
+		for _, a := range []string{"direction", "edge", "active_low", "value"} {
+			f.writeAttr(dir, a, g.attrs[a])
+		}
+		var st unix.Stat_t
+		if unix.Stat(filepath.Join(dir, "value"), &st) != nil {
+			return
+		}
+		g.ino = st.Ino
+		g.edge, err = unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+		if err != nil {
+			return
+		}
+		f.gpios[n] = g
+	case "unexport":
+		if g := f.gpios[n]; g != nil {
+			os.RemoveAll(dir)
+			unix.Close(g.edge)
+			delete(f.gpios, n)
+		}
+	}
+}
+
+// gpioAttr handles writes to the GPIO attribute files.
+func (f *Sysfs) gpioAttr(dir, name, s string) {
+	var g *gpioState
+	for _, st := range f.gpios {
+		if st.dir == dir {
+			g = st
+		}
+	}
+	if g == nil {
+		return
+	}
+	v := g.attrs[name]
+	// Since the files are written without truncation, a shorter value
+	// may leave part of a previous value behind, so the attribute values
+	// are matched by prefix.
+	for _, a := range attrValues[name] {
+		if strings.HasPrefix(s, a) {
+			v = a
+			break
+		}
+	}
+	switch name {
+	case "direction":
+		switch v {
+		case "high":
+			v = "out"
+			g.attrs["value"] = "1"
+			f.writeAttr(dir, "value", "1")
+		case "low":
+			v = "out"
+			g.attrs["value"] = "0"
+			f.writeAttr(dir, "value", "0")
+		}
+	case "value":
+		if g.attrs["direction"] != "out" {
+			// Inputs cannot be written.
+			v = g.attrs["value"]
+		}
+	}
+	g.attrs[name] = v
+	if s != v {
+		f.writeAttr(dir, name, v)
+	}
+}
+
+// exportPwm handles writes to the PWM export and unexport files.
+func (f *Sysfs) exportPwm(name, s string) {
+	os.Truncate(filepath.Join(f.root, pwmDir, name), 0)
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return
+	}
+	dir := filepath.Join(f.root, pwmDir, fmt.Sprintf("pwm%d", n))
+	switch name {
+	case "export":
+		if f.pwms[n] != nil || os.Mkdir(dir, 0755) != nil {
+			return
+		}
+		if f.watch(dir) != nil {
+			return
+		}
+		for _, a := range []string{"duty_cycle", "enable", "period"} {
+			os.WriteFile(filepath.Join(dir, a), nil, 0644)
+		}
+		f.pwms[n] = &pwmState{dir: dir}
+	case "unexport":
+		if f.pwms[n] != nil {
+			os.RemoveAll(dir)
+			delete(f.pwms, n)
+		}
+	}
+}
+
+// pwmAttr handles writes to the PWM attribute files.
+// The PWM values are written at offset 0 of files that are held open, so
+// the file is truncated once the value is read, as a sysfs attribute
+// store replaces the previous value.
+func (f *Sysfs) pwmAttr(dir, name, s string) {
+	var p *pwmState
+	for _, st := range f.pwms {
+		if st.dir == dir {
+			p = st
+		}
+	}
+	if p == nil {
+		return
+	}
+	os.Truncate(filepath.Join(dir, name), 0)
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return
+	}
+	switch name {
+	case "period":
+		p.period = v
+	case "duty_cycle":
+		p.duty = v
+	case "enable":
+		p.enable = v != 0
+	}
+}
+
+// writeAttr writes an attribute file.
+func (f *Sysfs) writeAttr(dir, name, v string) error {
+	return os.WriteFile(filepath.Join(dir, name), []byte(v+"\n"), 0644)
+}
@@ -0,0 +1,216 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sysfstest_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aamcrae/gpio"
+	"github.com/aamcrae/gpio/sysfstest"
+	"golang.org/x/sys/unix"
+)
+
+// newSysfs creates an emulated tree and points the io package at it.
+func newSysfs(t *testing.T) *sysfstest.Sysfs {
+	fs, err := sysfstest.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldRoot, oldVerify := io.Root, io.Verify
+	io.Root, io.Verify = fs.Root(), true
+	t.Cleanup(func() {
+		io.Root, io.Verify = oldRoot, oldVerify
+		fs.Close()
+	})
+	return fs
+}
+
+// waitFor waits for the emulation to reach a condition.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for end := time.Now().Add(2 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(end) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// attrIs returns a condition that an attribute has a value.
+func attrIs(get func(int) (string, error), gpio int, want string) func() bool {
+	return func() bool {
+		v, err := get(gpio)
+		return err == nil && v == want
+	}
+}
+
+func TestPin(t *testing.T) {
+	fs := newSysfs(t)
+	p, err := io.OutputPin(17, io.ActiveLow())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fs.Exported(17) {
+		t.Fatal("gpio17 not exported")
+	}
+	waitFor(t, "direction out", attrIs(fs.Direction, 17, "out"))
+	waitFor(t, "active low", func() bool {
+		v, err := fs.ActiveLow(17)
+		return err == nil && v
+	})
+	for _, v := range []int{1, 0, 1} {
+		if err := p.Set(v); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "value", func() bool {
+			got, err := fs.Value(17)
+			return err == nil && got == v
+		})
+		if got, err := p.Get(); err != nil || got != v {
+			t.Errorf("Get: got %d, %v, want %d", got, err, v)
+		}
+	}
+	p.Close()
+	waitFor(t, "unexport", func() bool { return !fs.Exported(17) })
+}
+
+func TestPinInput(t *testing.T) {
+	fs := newSysfs(t)
+	p, err := io.Pin(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if err := p.Set(1); !errors.Is(err, io.ErrNotOutput) {
+		t.Errorf("Set on input: got %v, want ErrNotOutput", err)
+	}
+	for _, v := range []int{1, 0} {
+		if err := fs.SetValue(4, v); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := p.Get(); err != nil || got != v {
+			t.Errorf("Get: got %d, %v, want %d", got, err, v)
+		}
+	}
+}
+
+func TestPinEdge(t *testing.T) {
+	fs := newSysfs(t)
+	p, err := io.Pin(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if err := p.Edge(io.RISING); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "edge rising", attrIs(fs.Edge, 5, "rising"))
+	v, err := os.Open(filepath.Join(fs.Root(), "sys/class/gpio/gpio5/value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	type result struct {
+		n       int
+		revents int16
+		err     error
+	}
+	res := make(chan result)
+	wait := func(timeout int) {
+		pfd := []unix.PollFd{{Fd: int32(v.Fd()), Events: unix.POLLPRI | unix.POLLERR}}
+		n, err := fs.Poll(pfd, timeout)
+		res <- result{n, pfd[0].Revents, err}
+	}
+	go wait(1000)
+	waitFor(t, "poll", func() bool { return fs.Polling() == 1 })
+	if err := fs.SetValue(5, 1); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-res; r.err != nil || r.n != 1 || r.revents != unix.POLLPRI|unix.POLLERR {
+		t.Errorf("rising edge: got %d, 0x%x, %v", r.n, r.revents, r.err)
+	}
+	if got, err := fs.Value(5); err != nil || got != 1 {
+		t.Errorf("Value: got %d, %v, want 1", got, err)
+	}
+	// The edge is cleared once reported, and a falling edge is not signalled.
+	if err := fs.SetValue(5, 0); err != nil {
+		t.Fatal(err)
+	}
+	go wait(50)
+	if r := <-res; r.err != nil || r.n != 0 || r.revents != 0 {
+		t.Errorf("falling edge: got %d, 0x%x, %v, want timeout", r.n, r.revents, r.err)
+	}
+	if err := p.Edge(io.BOTH); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "edge both", attrIs(fs.Edge, 5, "both"))
+	if err := fs.SetValue(5, 1); err != nil {
+		t.Fatal(err)
+	}
+	go wait(1000)
+	if r := <-res; r.err != nil || r.n != 1 || r.revents != unix.POLLPRI|unix.POLLERR {
+		t.Errorf("pending edge: got %d, 0x%x, %v", r.n, r.revents, r.err)
+	}
+}
+
+func TestHwPWM(t *testing.T) {
+	fs := newSysfs(t)
+	p, err := io.NewHwPWM(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fs.PwmExported(1) {
+		t.Fatal("pwm1 not exported")
+	}
+	pwmIs := func(period time.Duration, duty int64, enabled bool) func() bool {
+		return func() bool {
+			p, d, e, err := fs.Pwm(1)
+			return err == nil && p == period.Nanoseconds() && d == duty && e == enabled
+		}
+	}
+	waitFor(t, "default settings", pwmIs(100*time.Millisecond, 0, true))
+	// Shorter values are written over longer ones.
+	if err := p.Set(20*time.Millisecond, 50); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "20ms 50%", pwmIs(20*time.Millisecond, 10000000, true))
+	if err := p.Set(time.Millisecond, 10); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "1ms 10%", pwmIs(time.Millisecond, 100000, true))
+	p.Close()
+	waitFor(t, "unexport", func() bool { return !fs.PwmExported(1) })
+}
+
+func TestVerify(t *testing.T) {
+	fs := newSysfs(t)
+	// Without the emulation the exported files never appear.
+	fs.Close()
+	_, err := io.Pin(6, io.VerifyTimeout(20*time.Millisecond))
+	var ve *io.VerifyError
+	if !errors.As(err, &ve) || ve.Owner != "" {
+		t.Errorf("Pin: got %v, want VerifyError for a missing file", err)
+	}
+	// A missing file is not reported as a timeout.
+	if errors.Is(err, io.ErrTimeout) || !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Pin: got %v, want ErrNotExist and not ErrTimeout", err)
+	}
+	if _, err := io.NewHwPWM(2, io.VerifyStrategy(io.VerifyPoll), io.VerifyTimeout(20*time.Millisecond)); !errors.As(err, &ve) {
+		t.Errorf("NewHwPWM: got %v, want VerifyError", err)
+	}
+}
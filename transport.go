@@ -0,0 +1,127 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// I2C transports, allowing the messages of an I2C bus to be
+// intercepted, such as for recording and replay.
+
+package io
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// I2cTransport sends the messages of an I2C transaction.
+// The messages are sent as a single transaction, with read data
+// returned in the message buffers.
+type I2cTransport interface {
+	Transfer(msgs []I2cMsg) error
+	Close() error
+}
+
+// i2cTransport is the adapter for an I2cTransport.
+type i2cTransport struct {
+	t      I2cTransport
+	mu     sync.Mutex
+	closed bool
+}
+
+// devTransport is an I2cTransport for a /dev/i2c device.
+type devTransport struct {
+	d *i2cDev
+}
+
+// OpenI2cTransport opens the /dev/i2c device as a transport.
+func OpenI2cTransport(bus int) (I2cTransport, error) {
+	name := fmt.Sprintf("i2c-%d", bus)
+	d, funcs, err := openI2cDev(name)
+	if err != nil {
+		return nil, err
+	}
+	if funcs&i2cFuncI2c == 0 {
+		d.close()
+		return nil, busError(name, -1, "funcs", ErrNotSupported)
+	}
+	return &devTransport{d: d}, nil
+}
+
+// Transfer sends the messages using the I2C_RDWR ioctl.
+func (t *devTransport) Transfer(msgs []I2cMsg) error {
+	t.d.lock()
+	defer t.d.unlock()
+	return t.d.transfer(msgs)
+}
+
+// Close closes the device.
+func (t *devTransport) Close() error {
+	return t.d.close()
+}
+
+// NewI2cTransport creates an I2C using the transport, with the name
+// used in errors and the registry.
+// The bus reports support for I2C messages and 10 bit addresses only,
+// so SMBus commands are always emulated using I2C messages, and the
+// emulated messages are what a recording contains and a replay expects.
+// Timeout, Retries and TenBit are not supported (10 bit addresses are
+// selected using I2cFlagTenBit).
+// The transport is closed when the I2C is closed, and the error from
+// closing it is returned by CloseErr. A second close does nothing.
+func NewI2cTransport(t I2cTransport, name string, opts ...Option) (*I2C, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &I2C{
+		bus:      -1,
+		label:    name,
+		adapter:  &i2cTransport{t: t},
+		funcs:    i2cFuncI2c | i2cFuncTenBitAddr,
+		consumer: cfg.consumer,
+		shared:   cfg.consumerSet,
+	}, nil
+}
+
+func (a *i2cTransport) lock() {
+	a.mu.Lock()
+}
+
+func (a *i2cTransport) unlock() {
+	a.mu.Unlock()
+}
+
+func (a *i2cTransport) transfer(msgs []I2cMsg) error {
+	if a.closed {
+		return os.ErrClosed
+	}
+	return a.t.Transfer(msgs)
+}
+
+func (a *i2cTransport) smbus(addr uint16, pec bool, args *i2c_smbus_ioctl_data) error {
+	return ErrNotSupported
+}
+
+func (a *i2cTransport) control(req, arg uintptr) error {
+	return ErrNotSupported
+}
+
+func (a *i2cTransport) close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil
+	}
+	a.closed = true
+	return a.t.Close()
+}
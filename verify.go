@@ -0,0 +1,169 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Verification that exported files are writable.
+
+package io
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Verification strategies
+const (
+	VerifyDefault = iota // Inotify if Verify is set, otherwise none
+	VerifyNone    = iota // Do not wait for files to become writable
+	VerifyPoll    = iota // Poll the file permissions
+	VerifyInotify = iota // Wait for attribute changes using inotify
+)
+
+// VerifyError is returned when an exported file does not become
+// writable before the verification timeout. It reports the owner, group
+// and mode of the file so that the udev rules can be checked.
+// If the file exists but the wait timed out, it matches ErrTimeout when
+// used with errors.Is. Otherwise the cause is matched, such as
+// os.ErrNotExist for a file that never appeared.
+type VerifyError struct {
+	File     string
+	Owner    string // Owner name (or uid if unknown), empty if the file does not exist
+	Group    string // Group name (or gid if unknown)
+	Mode     os.FileMode
+	Timeout  time.Duration
+	Err      error // Last error from checking access
+	timedOut bool  // The file exists, and the wait timed out
+}
+
+func (e *VerifyError) Error() string {
+	if e.Owner == "" {
+		return fmt.Sprintf("%s: not writable after %v: %v", e.File, e.Timeout, e.Err)
+	}
+	return fmt.Sprintf("%s: not writable after %v (owner %s, group %s, mode %v): %v", e.File, e.Timeout, e.Owner, e.Group, e.Mode, e.Err)
+}
+
+func (e *VerifyError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the target is ErrTimeout and the wait timed out.
+func (e *VerifyError) Is(target error) bool {
+	return target == ErrTimeout && e.timedOut
+}
+
+// strategy returns the verification strategy selected, using def if
+// the default is selected and the Verify variable is not set.
+func (c *config) strategy(def int) int {
+	if c.verify != VerifyDefault {
+		return c.verify
+	}
+	if Verify {
+		return VerifyInotify
+	}
+	return def
+}
+
+// verifyFile waits for a file to become writable using the strategy selected.
+func verifyFile(f string, strategy int, tout time.Duration) error {
+	var err error
+	var timedOut bool
+	switch strategy {
+	case VerifyNone:
+		return nil
+	case VerifyInotify:
+		timedOut, err = inotifyWait(f, tout)
+	default:
+		timedOut, err = pollWait(f, tout)
+	}
+	if err == nil {
+		return nil
+	}
+	ve := &VerifyError{File: f, Timeout: tout, Err: err}
+	if fi, serr := os.Stat(f); serr == nil {
+		ve.timedOut = timedOut
+		ve.Mode = fi.Mode()
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			ve.Owner = strconv.Itoa(int(st.Uid))
+			if u, uerr := user.LookupId(ve.Owner); uerr == nil {
+				ve.Owner = u.Username
+			}
+			ve.Group = strconv.Itoa(int(st.Gid))
+			if g, gerr := user.LookupGroupId(ve.Group); gerr == nil {
+				ve.Group = g.Name
+			}
+		}
+	}
+	return ve
+}
+
+// pollWait polls the file until it is writable, returning the last
+// access error if the timeout expires, and whether it expired.
+func pollWait(f string, tout time.Duration) (bool, error) {
+	deadline := time.Now().Add(tout)
+	for {
+		err := unix.Access(f, unix.W_OK)
+		if err == nil || time.Now().After(deadline) {
+			return err != nil, err
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// inotifyWait waits for the file to become writable, using inotify to
+// wake when the mode or ownership of the file changes.
+// sysfs does not generate events when attribute files are created, so
+// the file is polled until it exists.
+// Whether the timeout expired is returned with the last error.
+func inotifyWait(f string, tout time.Duration) (bool, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return false, err
+	}
+	defer unix.Close(fd)
+	deadline := time.Now().Add(tout)
+	watched := false
+	buf := make([]byte, unix.SizeofInotifyEvent*16+unix.PathMax)
+	for {
+		if !watched {
+			_, werr := unix.InotifyAddWatch(fd, f, unix.IN_ATTRIB)
+			watched = werr == nil
+		}
+		// Check after adding the watch so that a change is not missed.
+		err = unix.Access(f, unix.W_OK)
+		remaining := time.Until(deadline)
+		if err == nil || remaining <= 0 {
+			return err != nil, err
+		}
+		if !watched {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		pfd := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		_, perr := unix.Poll(pfd, msRoundUp(remaining))
+		if perr != nil && perr != unix.EINTR {
+			return false, perr
+		}
+		// Drain the events.
+		for {
+			if _, rerr := unix.Read(fd, buf); rerr != nil {
+				break
+			}
+		}
+	}
+}
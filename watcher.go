@@ -0,0 +1,266 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Watching many input pins using a single epoll descriptor.
+
+package io
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+const watcherQueueSize = 256 // Size of queue for watcher events
+
+// Watchable is implemented by the pins that can be registered
+// with a Watcher (such as Gpio, Line and simulated pins).
+type Watchable interface {
+	GpioPin
+	// WatchFd returns the file descriptor and epoll events used to
+	// watch the pin for edges.
+	WatchFd() (int, uint32, error)
+	// WatchEvents returns the pending edge events once the file
+	// descriptor is ready.
+	WatchEvents() ([]Event, error)
+}
+
+// WatchEvent is an edge event detected on a pin registered with a Watcher.
+// If reading the events from the pin fails, Err is set, and the pin is
+// no longer watched.
+type WatchEvent struct {
+	Pin Watchable
+	Event
+	Err error
+}
+
+// Watcher watches many input pins for edges using a single epoll
+// descriptor and goroutine. The events are delivered either through
+// a channel or a callback.
+// Pins must have edge detection enabled before being added, and
+// should be removed before being closed. Get and GetTimeout should
+// not be called on pins registered with a Watcher.
+type Watcher struct {
+	epfd   int
+	efd    int // eventfd used to stop the watcher
+	mu     sync.Mutex
+	pins   map[int32]Watchable
+	c      chan WatchEvent
+	f      func(WatchEvent)
+	done   chan struct{}
+	closed bool
+	runner uint64 // Id of the goroutine delivering the events
+}
+
+// NewWatcher creates a Watcher that delivers the events through the
+// channel returned by Events. The watcher is closed when the context
+// is done. If the channel is full, events are discarded, and
+// counted in the Dropped field of the events.
+func NewWatcher(ctx context.Context) (*Watcher, error) {
+	return newWatcher(ctx, make(chan WatchEvent, watcherQueueSize), nil)
+}
+
+// NewWatcherFunc creates a Watcher that calls f for every event.
+// f is called from the watcher goroutine, so events are not
+// read while f is running. f may call Add, Remove and Close.
+// The watcher is closed when the context is done.
+func NewWatcherFunc(ctx context.Context, f func(WatchEvent)) (*Watcher, error) {
+	return newWatcher(ctx, nil, f)
+}
+
+func newWatcher(ctx context.Context, c chan WatchEvent, f func(WatchEvent)) (*Watcher, error) {
+	w := &Watcher{pins: make(map[int32]Watchable), c: c, f: f, done: make(chan struct{})}
+	var err error
+	w.epfd, err = unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	w.efd, err = unix.Eventfd(0, unix.EFD_CLOEXEC)
+	if err != nil {
+		unix.Close(w.epfd)
+		return nil, err
+	}
+	err = unix.EpollCtl(w.epfd, unix.EPOLL_CTL_ADD, w.efd, &unix.EpollEvent{Events: unix.EPOLLIN, Fd: int32(w.efd)})
+	if err != nil {
+		unix.Close(w.efd)
+		unix.Close(w.epfd)
+		return nil, err
+	}
+	go w.run()
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				w.Close()
+			case <-w.done:
+			}
+		}()
+	}
+	return w, nil
+}
+
+// Events returns the channel that the events are delivered on.
+// The channel is closed when the watcher is closed. If the watcher
+// was created with NewWatcherFunc, nil is returned.
+func (w *Watcher) Events() <-chan WatchEvent {
+	return w.c
+}
+
+// Add registers a pin with the watcher.
+func (w *Watcher) Add(p Watchable) error {
+	fd, events, err := p.WatchFd()
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return os.ErrClosed
+	}
+	err = unix.EpollCtl(w.epfd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Events: events, Fd: int32(fd)})
+	if err != nil {
+		return err
+	}
+	w.pins[int32(fd)] = p
+	return nil
+}
+
+// Remove removes a pin from the watcher.
+func (w *Watcher) Remove(p Watchable) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return os.ErrClosed
+	}
+	for fd, wp := range w.pins {
+		if wp == p {
+			delete(w.pins, fd)
+			return unix.EpollCtl(w.epfd, unix.EPOLL_CTL_DEL, int(fd), nil)
+		}
+	}
+	return os.ErrNotExist
+}
+
+// Close stops the watcher, and waits for the watcher goroutine to exit,
+// including a callback that is running. If called from the callback,
+// Close returns without waiting, and no further events are delivered
+// once the callback returns.
+// The pins registered are not closed.
+func (w *Watcher) Close() {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return
+	}
+	w.closed = true
+	unix.Write(w.efd, []byte{1, 0, 0, 0, 0, 0, 0, 0})
+	wait := w.runner != goid()
+	w.mu.Unlock()
+	if wait {
+		<-w.done
+	}
+}
+
+// run waits for events and delivers them. The descriptors are closed
+// when the watcher is stopped.
+func (w *Watcher) run() {
+	w.mu.Lock()
+	w.runner = goid()
+	w.mu.Unlock()
+	defer close(w.done)
+	if w.c != nil {
+		defer close(w.c)
+	}
+	defer func() {
+		w.mu.Lock()
+		w.closed = true
+		unix.Close(w.efd)
+		unix.Close(w.epfd)
+		w.mu.Unlock()
+	}()
+	var dropped uint64
+	events := make([]unix.EpollEvent, 16)
+	for {
+		n, err := unix.EpollWait(w.epfd, events, -1)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		for _, ev := range events[:n] {
+			w.mu.Lock()
+			p := w.pins[ev.Fd]
+			closed := w.closed
+			w.mu.Unlock()
+			if closed {
+				return
+			}
+			if p == nil {
+				continue
+			}
+			evs, err := p.WatchEvents()
+			if err != nil {
+				// Stop watching the pin so that a persistent
+				// error does not cause a busy loop.
+				w.mu.Lock()
+				delete(w.pins, ev.Fd)
+				unix.EpollCtl(w.epfd, unix.EPOLL_CTL_DEL, int(ev.Fd), nil)
+				w.mu.Unlock()
+				evs = nil
+				w.deliver(WatchEvent{Pin: p, Err: err}, &dropped)
+			}
+			for _, e := range evs {
+				w.deliver(WatchEvent{Pin: p, Event: e}, &dropped)
+			}
+		}
+	}
+}
+
+// deliver calls the callback with the event, or sends it on the channel.
+func (w *Watcher) deliver(we WatchEvent, dropped *uint64) {
+	if w.f != nil {
+		w.mu.Lock()
+		if w.closed {
+			w.mu.Unlock()
+			return
+		}
+		w.mu.Unlock()
+		w.f(we)
+		return
+	}
+	we.Dropped = *dropped
+	select {
+	case w.c <- we:
+	default:
+		*dropped++
+	}
+}
+
+// goid returns the id of the calling goroutine, which is read from
+// the header of its stack trace.
+func goid() uint64 {
+	var buf [64]byte
+	b := bytes.TrimPrefix(buf[:runtime.Stack(buf[:], false)], []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i >= 0 {
+		b = b[:i]
+	}
+	id, _ := strconv.ParseUint(string(b), 10, 64)
+	return id
+}
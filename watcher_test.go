@@ -0,0 +1,193 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package io_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aamcrae/gpio"
+	"github.com/aamcrae/gpio/sim"
+)
+
+// watchedPins opens the pins of a chip as inputs detecting both edges.
+func watchedPins(t *testing.T, c *sim.Chip, n int) []*sim.Pin {
+	var pins []*sim.Pin
+	for i := 0; i < n; i++ {
+		p, err := c.Pin(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(p.Close)
+		if err := p.Edge(io.BOTH); err != nil {
+			t.Fatal(err)
+		}
+		pins = append(pins, p)
+	}
+	return pins
+}
+
+// next returns the next event from the watcher.
+func next(t *testing.T, c <-chan io.WatchEvent) io.WatchEvent {
+	t.Helper()
+	select {
+	case e := <-c:
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+	}
+	return io.WatchEvent{}
+}
+
+func TestWatcher(t *testing.T) {
+	c := sim.NewChip(2)
+	pins := watchedPins(t, c, 2)
+	w, err := io.NewWatcher(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for _, p := range pins {
+		if err := w.Add(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.Drive(1, 1)
+	if e := next(t, w.Events()); e.Pin != pins[1] || e.Edge != io.RISING || e.Level != 1 || e.Err != nil {
+		t.Errorf("pin 1 rising: got %+v", e)
+	}
+	c.Drive(0, 1)
+	c.Drive(0, 0)
+	if e := next(t, w.Events()); e.Pin != pins[0] || e.Edge != io.RISING {
+		t.Errorf("pin 0 rising: got %+v", e)
+	}
+	if e := next(t, w.Events()); e.Pin != pins[0] || e.Edge != io.FALLING || e.Seq != 2 {
+		t.Errorf("pin 0 falling: got %+v", e)
+	}
+	// A pin can be removed after edge detection is disabled.
+	if err := pins[1].Edge(io.NONE); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Remove(pins[1]); err != nil {
+		t.Errorf("Remove: %v", err)
+	}
+	if err := w.Remove(pins[1]); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("second Remove: got %v, want ErrNotExist", err)
+	}
+	w.Close()
+	if _, ok := <-w.Events(); ok {
+		t.Error("event after Close")
+	}
+	if err := w.Add(pins[0]); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Add after Close: got %v, want ErrClosed", err)
+	}
+}
+
+func TestWatcherCloseInCallback(t *testing.T) {
+	c := sim.NewChip(1)
+	pins := watchedPins(t, c, 1)
+	got := make(chan io.WatchEvent, 10)
+	var w *io.Watcher
+	w, err := io.NewWatcherFunc(context.Background(), func(e io.WatchEvent) {
+		got <- e
+		w.Close()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add(pins[0]); err != nil {
+		t.Fatal(err)
+	}
+	c.Drive(0, 1)
+	next(t, got)
+	c.Drive(0, 0)
+	select {
+	case e := <-got:
+		t.Errorf("event after Close: %+v", e)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestWatcherCloseWaits(t *testing.T) {
+	c := sim.NewChip(1)
+	pins := watchedPins(t, c, 1)
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	w, err := io.NewWatcherFunc(context.Background(), func(e io.WatchEvent) {
+		close(entered)
+		<-release
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add(pins[0]); err != nil {
+		t.Fatal(err)
+	}
+	c.Drive(0, 1)
+	<-entered
+	closed := make(chan struct{})
+	go func() {
+		w.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Fatal("Close returned while the callback was running")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close did not return after the callback")
+	}
+}
+
+// failingPin is a pin whose events cannot be read.
+type failingPin struct {
+	*sim.Pin
+}
+
+var errRead = errors.New("read failed")
+
+func (p failingPin) WatchEvents() ([]io.Event, error) {
+	p.Pin.WatchEvents()
+	return nil, errRead
+}
+
+func TestWatcherError(t *testing.T) {
+	c := sim.NewChip(1)
+	pins := watchedPins(t, c, 1)
+	w, err := io.NewWatcher(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	fp := failingPin{pins[0]}
+	if err := w.Add(fp); err != nil {
+		t.Fatal(err)
+	}
+	c.Drive(0, 1)
+	if e := next(t, w.Events()); e.Pin != fp || !errors.Is(e.Err, errRead) {
+		t.Errorf("got %+v, want read error", e)
+	}
+	// The pin is no longer watched.
+	if err := w.Remove(fp); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Remove: got %v, want ErrNotExist", err)
+	}
+}